@@ -5,5 +5,30 @@
 typedef u32 ipv4_addr;
 // A basic ipv6 address represented as a u32
 typedef u32 ipv6_addr;
-// A duration in NS stored as a u64
-typedef u64 duration;
\ No newline at end of file
+// A duration in NS stored as a u64, exported in seconds by metrics
+typedef u64 duration;
+// A size or amount of data in bytes, e.g. of a packet or a write
+typedef u64 byte_count;
+// A timestamp from bpf_ktime_get_ns(), printed as wall clock time
+typedef u64 ktime;
+// A timestamp from bpf_ktime_get_boot_ns(), printed as wall clock time
+typedef u64 boottime;
+// A char printed as a number, e.g. for a small counter
+typedef char numeric_char;
+// An unsigned char printed as a character, instead of a number as for u8
+typedef unsigned char text_char;
+
+// A process id, printed along with the comm of the process
+typedef u32 bee_pid;
+// A user id, printed as the user name from /etc/passwd
+typedef u32 bee_uid;
+// A group id, printed as the group name from /etc/group
+typedef u32 bee_gid;
+// An error number, positive or negative, printed as its symbolic name (e.g. ENOENT)
+typedef s32 bee_errno;
+// A syscall number, printed as the syscall name for the running architecture
+typedef u32 bee_syscall_nr;
+// A network interface index, printed as the interface name
+typedef u32 bee_ifindex;
+// A cgroup v2 id (e.g. from bpf_get_current_cgroup_id()), printed as the cgroup path
+typedef u64 bee_cgroup_id;
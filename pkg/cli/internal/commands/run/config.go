@@ -0,0 +1,196 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/solo-io/bumblebee/pkg/stats"
+)
+
+// runConfig holds the settings of a run which are too detailed for flags,
+// read from the file given by --run-config. Flags take precedence over it.
+//
+//	metrics:
+//	  namespace: bee
+//	  constLabels:
+//	    cluster: prod
+//	  maps:
+//	    counter_events_hash:
+//	      name: tcp_connections
+//	      help: TCP connections per source and destination address
+//	      dropLabels: [saddr]
+//	      rewrite:
+//	        - label: daddr
+//	          regex: '10\..*'
+//	          replacement: private
+//	      seriesLimit: 1000
+type runConfig struct {
+	Metrics metricsConfig `yaml:"metrics"`
+}
+
+type metricsConfig struct {
+	Namespace   string                  `yaml:"namespace"`
+	ConstLabels map[string]string       `yaml:"constLabels"`
+	Maps        map[string]metricConfig `yaml:"maps"`
+}
+
+type metricConfig struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	Unit string `yaml:"unit"`
+
+	DropLabels  []string        `yaml:"dropLabels"`
+	KeepLabels  []string        `yaml:"keepLabels"`
+	Rewrite     []rewriteConfig `yaml:"rewrite"`
+	SeriesLimit int             `yaml:"seriesLimit"`
+}
+
+type rewriteConfig struct {
+	Label       string `yaml:"label"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+func readRunConfig(path string) (*runConfig, error) {
+	cfg := &runConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read run config: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(contents, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse run config '%s': %w", path, err)
+	}
+	return cfg, nil
+}
+
+// buildNamingOpts merges the metric naming of the run config with the flags
+func buildNamingOpts(cfg *runConfig, opts *runOptions) (stats.NamingOpts, error) {
+	naming := stats.NamingOpts{
+		Namespace:   cfg.Metrics.Namespace,
+		ConstLabels: map[string]string{},
+		Metrics:     map[string]stats.MetricOpts{},
+	}
+	if opts.metricsNamespace != "" {
+		naming.Namespace = opts.metricsNamespace
+	}
+	for k, v := range cfg.Metrics.ConstLabels {
+		naming.ConstLabels[k] = v
+	}
+	for k, v := range opts.metricsConstLabels {
+		naming.ConstLabels[k] = v
+	}
+	for mapName, metric := range cfg.Metrics.Maps {
+		naming.Metrics[mapName] = stats.MetricOpts{
+			Name: metric.Name,
+			Help: metric.Help,
+			Unit: metric.Unit,
+		}
+	}
+
+	setMetric := func(mapName string, set func(*stats.MetricOpts)) {
+		metric := naming.Metrics[mapName]
+		set(&metric)
+		naming.Metrics[mapName] = metric
+	}
+	err := parsePerMetricFlags([]perMetricFlag{
+		{"metric-name", opts.metricNames, func(mapName, v string) error {
+			setMetric(mapName, func(m *stats.MetricOpts) { m.Name = v })
+			return nil
+		}},
+		{"metric-help", opts.metricHelp, func(mapName, v string) error {
+			setMetric(mapName, func(m *stats.MetricOpts) { m.Help = v })
+			return nil
+		}},
+		{"metric-unit", opts.metricUnits, func(mapName, v string) error {
+			setMetric(mapName, func(m *stats.MetricOpts) { m.Unit = v })
+			return nil
+		}},
+	})
+	if err != nil {
+		return stats.NamingOpts{}, err
+	}
+	if err := naming.Validate(); err != nil {
+		return stats.NamingOpts{}, err
+	}
+	return naming, nil
+}
+
+// buildRelabelConfigs merges the relabel rules of the run config with the flags
+func buildRelabelConfigs(cfg *runConfig, opts *runOptions) (map[string]stats.RelabelConfig, error) {
+	rules := map[string]stats.RelabelConfig{}
+	for mapName, metric := range cfg.Metrics.Maps {
+		if len(metric.DropLabels) == 0 && len(metric.KeepLabels) == 0 && len(metric.Rewrite) == 0 && metric.SeriesLimit == 0 {
+			continue
+		}
+		relabel := stats.RelabelConfig{
+			DropLabels:  metric.DropLabels,
+			KeepLabels:  metric.KeepLabels,
+			SeriesLimit: metric.SeriesLimit,
+		}
+		for _, rewrite := range metric.Rewrite {
+			relabel.Rewrites = append(relabel.Rewrites, stats.RewriteRule{
+				Label:       rewrite.Label,
+				Regex:       rewrite.Regex,
+				Replacement: rewrite.Replacement,
+			})
+		}
+		rules[mapName] = relabel
+	}
+
+	setRelabel := func(mapName string, set func(*stats.RelabelConfig)) {
+		relabel := rules[mapName]
+		set(&relabel)
+		rules[mapName] = relabel
+	}
+	err := parsePerMetricFlags([]perMetricFlag{
+		{"metric-drop-labels", opts.metricDropLabels, func(mapName, v string) error {
+			setRelabel(mapName, func(r *stats.RelabelConfig) { r.DropLabels = strings.Split(v, ",") })
+			return nil
+		}},
+		{"metric-keep-labels", opts.metricKeepLabels, func(mapName, v string) error {
+			setRelabel(mapName, func(r *stats.RelabelConfig) { r.KeepLabels = strings.Split(v, ",") })
+			return nil
+		}},
+		{"metric-series-limit", opts.metricSeriesLimits, func(mapName, v string) error {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				return fmt.Errorf("series limit must be a positive number, found '%s'", v)
+			}
+			setRelabel(mapName, func(r *stats.RelabelConfig) { r.SeriesLimit = limit })
+			return nil
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// perMetricFlag is a repeatable flag of the format "map_name,value"
+type perMetricFlag struct {
+	flag   string
+	values []string
+	set    func(mapName string, value string) error
+}
+
+func parsePerMetricFlags(flags []perMetricFlag) error {
+	for _, setting := range flags {
+		for _, value := range setting.values {
+			split := strings.Index(value, ",")
+			if split == -1 {
+				return fmt.Errorf("could not parse %s: %s", setting.flag, value)
+			}
+			if err := setting.set(value[:split], value[split+1:]); err != nil {
+				return fmt.Errorf("could not parse %s: %w", setting.flag, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/solo-io/bumblebee/pkg/loader"
+	"github.com/solo-io/bumblebee/pkg/tui"
+)
+
+const (
+	// Render the maps in the TUI
+	outputTUI = "tui"
+	// Write one JSON object per event to stdout
+	outputJSON = "json"
+	// Export the events of print maps as OTLP logs, using the --otlp-* flags
+	outputOTLP = "otlp"
+	// Write events to rotated files, file:/path
+	outputFile = "file"
+)
+
+const outputDescription string = "Where events are written, can be repeated. Format is \"output[,buffer=<size>][,drop=<newest|oldest|none>]\" " +
+	"where output is tui, json to write one JSON object per event to stdout, otlp to export the events of print maps as OTLP logs " +
+	"to the endpoint set by the --otlp-* flags, or file:<path> to write events to files. Each output buffers its events on its own, " +
+	"by default 1024 of them, dropping the newest once full. Defaults to tui, or none with --no-tty. Outputs other than tui imply --no-tty. " +
+	"Files also take [,format=<jsonl|csv|parquet>][,max-size=<size, e.g. 100MB>][,max-age=<duration>][,compress], " +
+	"the format defaulting to the extension of the path"
+
+// outputSpec is a parsed --output flag
+type outputSpec struct {
+	// The output as given, without its options
+	name string
+	kind string
+	// What follows the kind, e.g. the path of file:/path
+	arg        string
+	bufferSize int
+	dropPolicy loader.DropPolicy
+
+	// file outputs only
+	fileFormat string
+	maxSize    int64
+	maxAge     time.Duration
+	compress   bool
+}
+
+func parseOutputs(outputs []string) ([]outputSpec, error) {
+	var specs []outputSpec
+	seen := map[string]bool{}
+	for _, output := range outputs {
+		parts := strings.Split(output, ",")
+		spec := outputSpec{name: parts[0]}
+		spec.kind, spec.arg, _ = strings.Cut(parts[0], ":")
+		switch spec.kind {
+		case outputTUI, outputJSON, outputOTLP:
+			if spec.arg != "" {
+				return nil, fmt.Errorf("output '%s' doesn't take an argument", spec.kind)
+			}
+		case outputFile:
+			if spec.arg == "" {
+				return nil, fmt.Errorf("output '%s' needs a path, e.g. %s:/var/log/bee/events.jsonl", spec.kind, spec.kind)
+			}
+		default:
+			return nil, fmt.Errorf("unknown output '%s', expected one of %s, %s, %s or %s", spec.kind, outputTUI, outputJSON, outputOTLP, outputFile)
+		}
+		for _, opt := range parts[1:] {
+			key, value, hasValue := strings.Cut(opt, "=")
+			if spec.kind != outputFile {
+				switch key {
+				case "format", "max-size", "max-age", "compress":
+					return nil, fmt.Errorf("option '%s' only applies to %s outputs", key, outputFile)
+				}
+			}
+			switch key {
+			case "format":
+				switch value {
+				case loader.FileFormatJSON, loader.FileFormatCSV, loader.FileFormatParquet:
+				default:
+					return nil, fmt.Errorf("unknown format '%s' of output '%s', expected one of %s, %s or %s",
+						value, spec.name, loader.FileFormatJSON, loader.FileFormatCSV, loader.FileFormatParquet)
+				}
+				spec.fileFormat = value
+			case "max-size":
+				size, err := parseByteSize(value)
+				if err != nil {
+					return nil, fmt.Errorf("max-size of output '%s': %w", spec.name, err)
+				}
+				spec.maxSize = size
+			case "max-age":
+				age, err := time.ParseDuration(value)
+				if err != nil || age <= 0 {
+					return nil, fmt.Errorf("max-age of output '%s' must be a positive duration, found '%s'", spec.name, value)
+				}
+				spec.maxAge = age
+			case "compress":
+				spec.compress = true
+				if hasValue {
+					compress, err := strconv.ParseBool(value)
+					if err != nil {
+						return nil, fmt.Errorf("compress of output '%s' must be true or false, found '%s'", spec.name, value)
+					}
+					spec.compress = compress
+				}
+			case "buffer":
+				size, err := strconv.Atoi(value)
+				if err != nil || size <= 0 {
+					return nil, fmt.Errorf("buffer of output '%s' must be a positive number, found '%s'", spec.name, value)
+				}
+				spec.bufferSize = size
+			case "drop":
+				policy, err := loader.ParseDropPolicy(value)
+				if err != nil {
+					return nil, fmt.Errorf("output '%s': %w", spec.name, err)
+				}
+				spec.dropPolicy = policy
+			default:
+				return nil, fmt.Errorf("unknown option '%s' of output '%s'", key, spec.name)
+			}
+		}
+		if seen[spec.name] {
+			return nil, fmt.Errorf("output '%s' is given more than once", spec.name)
+		}
+		seen[spec.name] = true
+		specs = append(specs, spec)
+	}
+	if seen[outputTUI] && seen[outputJSON] {
+		return nil, fmt.Errorf("outputs %s and %s both write to stdout, only one can be used", outputTUI, outputJSON)
+	}
+	return specs, nil
+}
+
+// parseByteSize parses a number of bytes, optionally followed by KB, MB or GB, as multiples of 1024
+func parseByteSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(size)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			multiplier = m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("expected a positive size, e.g. 100MB, found '%s'", size)
+	}
+	return n * multiplier, nil
+}
+
+func hasOutput(specs []outputSpec, kind string) bool {
+	for _, spec := range specs {
+		if spec.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// buildWatcher fans events out to every output, tuiApp is only used by the tui output
+func buildWatcher(
+	ctx context.Context,
+	specs []outputSpec,
+	opts *runOptions,
+	tuiApp *tui.App,
+	parsedELF *loader.ParsedELF,
+	progLocation, progDigest string,
+) (loader.EventWatcher, error) {
+	var sinks []loader.Sink
+	for _, spec := range specs {
+		sink := loader.Sink{
+			Name:       spec.name,
+			BufferSize: spec.bufferSize,
+			DropPolicy: spec.dropPolicy,
+		}
+		switch spec.kind {
+		case outputTUI:
+			sink.Watcher = loader.NewStringWatcher(tuiApp)
+		case outputJSON:
+			sink.Watcher = loader.NewJSONWatcher(ctx, os.Stdout, progLocation)
+		case outputOTLP:
+			watcher, err := loader.NewOTLPLogsWatcher(ctx, &loader.OTLPLogsOpts{
+				Protocol:           opts.otlpProtocol,
+				Endpoint:           opts.otlpEndpoint,
+				Headers:            opts.otlpHeaders,
+				Insecure:           opts.otlpInsecure,
+				ResourceAttributes: opts.otlpResourceAttributes,
+				Program:            progLocation,
+				ProgramDigest:      progDigest,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not build output '%s': %w", spec.name, err)
+			}
+			sink.Watcher = watcher
+		case outputFile:
+			watcher, err := loader.NewFileWatcher(ctx, &loader.FileOpts{
+				Path:              spec.arg,
+				Format:            spec.fileFormat,
+				MaxSize:           spec.maxSize,
+				MaxAge:            spec.maxAge,
+				Compress:          spec.compress,
+				Program:           progLocation,
+				WatchedMaps:       parsedELF.WatchedMaps,
+				WatchedMapOptions: parsedELF.WatchedMapOptions,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not build output '%s': %w", spec.name, err)
+			}
+			sink.Watcher = watcher
+		}
+		sinks = append(sinks, sink)
+	}
+	return loader.NewFanoutWatcher(ctx, sinks...), nil
+}
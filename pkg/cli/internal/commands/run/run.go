@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf/rlimit"
 	"github.com/pkg/errors"
@@ -33,15 +34,73 @@ type runOptions struct {
 	filter       []string
 	histBuckets  []string
 	histValueKey []string
+	histObserve  []string
+	histType     []string
+	histFactor   []string
+	quantiles    []string
+	valueKey     []string
 	notty        bool
+	outputs      []string
 	pinMaps      string
 	pinProgs     string
 	promPort     uint32
+	runConfig    string
+
+	promListenAddress         string
+	promTLSCert               string
+	promTLSKey                string
+	promTLSClientCA           string
+	promBasicAuthUser         string
+	promBasicAuthPasswordFile string
+	promPprof                 bool
+	promFailFast              bool
+
+	metricsNamespace   string
+	metricsConstLabels map[string]string
+	metricNames        []string
+	metricHelp         []string
+	metricUnits        []string
+	metricDropLabels   []string
+	metricKeepLabels   []string
+	metricSeriesLimits []string
+	metricsSeriesTTL   time.Duration
+
+	promPush         string
+	promPushURL      string
+	promPushJob      string
+	promPushInterval time.Duration
+	promPushHeaders  map[string]string
+
+	metricsExporter        string
+	otlpEndpoint           string
+	otlpProtocol           string
+	otlpHeaders            map[string]string
+	otlpInsecure           bool
+	otlpExportInterval     time.Duration
+	otlpResourceAttributes map[string]string
+
+	statsdAddress       string
+	statsdPrefix        string
+	statsdMaxPacketSize int
+	statsdFlushInterval time.Duration
 }
 
+const (
+	prometheusExporter = "prometheus"
+	otlpExporter       = "otlp"
+	statsdExporter     = "statsd"
+	dogstatsdExporter  = "dogstatsd"
+)
+
 const histBucketsDescription string = "Buckets to use for histogram maps. Format is \"map_name,<buckets_limits>\"" +
 	"where <buckets_limits> is a comma separated list of bucket limits. For example: \"events,[1,2,3,4,5]\""
 
+const histObserveDescription string = "What histogram hash maps observe on each poll. Format is \"map_name,<value|delta>\" " +
+	"where value observes the current value of each entry, and delta how much it grew since the last poll. Defaults to value"
+
+const histTypeDescription string = "How histogram maps are exported. Format is \"map_name,<buckets|native|summary>\" " +
+	"where native exports a Prometheus native histogram, or an OTLP exponential histogram, and summary exports quantiles. Defaults to buckets"
+
 const filterDescription string = "Filter to apply to output from maps. Format is \"map_name,key_name,regex\" " +
 	"You can define a filter per map, if more than one defined, the last defined filter will take precedence"
 
@@ -52,10 +111,50 @@ func addToFlags(flags *pflag.FlagSet, opts *runOptions) {
 	flags.StringSliceVarP(&opts.filter, "filter", "f", []string{}, filterDescription)
 	flags.StringArrayVarP(&opts.histBuckets, "hist-buckets", "b", []string{}, histBucketsDescription)
 	flags.StringArrayVarP(&opts.histValueKey, "hist-value-key", "k", []string{}, "Key to use for histogram maps. Format is \"map_name,key_name\"")
+	flags.StringArrayVar(&opts.histObserve, "hist-observe", []string{}, histObserveDescription)
+	flags.StringArrayVar(&opts.histType, "hist-type", []string{}, histTypeDescription)
+	flags.StringArrayVar(&opts.histFactor, "hist-bucket-factor", []string{}, "Growth factor of the buckets of native histogram maps, which sets their resolution. Format is \"map_name,factor\", defaults to 1.1")
+	flags.StringArrayVar(&opts.quantiles, "summary-quantiles", []string{}, "Quantiles exported by summary maps. Format is \"map_name,[0.5,0.9,0.99]\", which is the default")
+	flags.StringArrayVar(&opts.valueKey, "value-key", []string{}, "Field of the events of a ring buffer map which a counter adds up, instead of counting events, or which a gauge is set to. Format is \"map_name,key_name\"")
 	flags.BoolVar(&opts.notty, "no-tty", false, "Set to true for running without a tty allocated, so no interaction will be expected or rich output will done")
+	flags.StringArrayVar(&opts.outputs, "output", []string{}, outputDescription)
 	flags.StringVar(&opts.pinMaps, "pin-maps", "", "Directory to pin maps to, left unpinned if empty")
 	flags.StringVar(&opts.pinProgs, "pin-progs", "", "Directory to pin progs to, left unpinned if empty")
 	flags.Uint32Var(&opts.promPort, "prom-port", 9091, "Specify the Prometheus listener port")
+	flags.StringVar(&opts.promListenAddress, "prom-listen-address", "", "Address the Prometheus listener binds, e.g. 127.0.0.1. All interfaces if empty")
+	flags.StringVar(&opts.promTLSCert, "prom-tls-cert", "", "Certificate file to serve Prometheus metrics over TLS, requires --prom-tls-key")
+	flags.StringVar(&opts.promTLSKey, "prom-tls-key", "", "Private key file of --prom-tls-cert")
+	flags.StringVar(&opts.promTLSClientCA, "prom-tls-client-ca", "", "CA file client certificates must be signed by, requires TLS")
+	flags.StringVar(&opts.promBasicAuthUser, "prom-basic-auth-user", "", "Username required to scrape Prometheus metrics, requires --prom-basic-auth-password-file")
+	flags.StringVar(&opts.promBasicAuthPasswordFile, "prom-basic-auth-password-file", "", "File holding the password required to scrape Prometheus metrics")
+	flags.BoolVar(&opts.promPprof, "prom-pprof", false, "Also serve /debug/pprof on the Prometheus listener")
+	flags.BoolVar(&opts.promFailFast, "prom-fail-fast", false, "Exit if the Prometheus listener can't bind its address, instead of only logging it")
+	flags.StringVar(&opts.promPush, "prom-push", "", "Also push Prometheus metrics, one of \"remote-write\" or \"pushgateway\"")
+	flags.StringVar(&opts.promPushURL, "prom-push-url", "", "remote_write endpoint, e.g. http://prometheus:9090/api/v1/write, or the base URL of the Pushgateway")
+	flags.StringVar(&opts.promPushJob, "prom-push-job", "bee", "Job metrics are pushed to the Pushgateway under")
+	flags.DurationVar(&opts.promPushInterval, "prom-push-interval", 15*time.Second, "How often Prometheus metrics are pushed, they are also pushed once more on shutdown")
+	flags.StringToStringVar(&opts.promPushHeaders, "prom-push-headers", nil, "Headers sent with every push, e.g. \"authorization=Bearer token\"")
+	flags.StringVar(&opts.runConfig, "run-config", "", "YAML file with settings of the run, e.g. metric names. Flags take precedence over it")
+	flags.StringVar(&opts.metricsNamespace, "metrics-namespace", "", "Prefix of every metric name. Defaults to ebpf_solo_io")
+	flags.StringToStringVar(&opts.metricsConstLabels, "metrics-const-labels", nil, "Labels added to every metric, e.g. \"node=node-1,cluster=prod\"")
+	flags.StringArrayVar(&opts.metricNames, "metric-name", []string{}, "Name of the metric of a map. Format is \"map_name,metric_name\"")
+	flags.StringArrayVar(&opts.metricHelp, "metric-help", []string{}, "Description of the metric of a map. Format is \"map_name,help\"")
+	flags.StringArrayVar(&opts.metricUnits, "metric-unit", []string{}, "Unit of the metric of a map, appended to its name. Format is \"map_name,unit\"")
+	flags.StringArrayVar(&opts.metricDropLabels, "metric-drop-labels", []string{}, "Labels removed from the metric of a map. Format is \"map_name,label[,label...]\"")
+	flags.StringArrayVar(&opts.metricKeepLabels, "metric-keep-labels", []string{}, "The only labels kept on the metric of a map. Format is \"map_name,label[,label...]\"")
+	flags.DurationVar(&opts.metricsSeriesTTL, "metrics-series-ttl", 0, "Remove series of metrics which weren't updated for this long, e.g. \"10m\". Series are kept forever if 0")
+	flags.StringArrayVar(&opts.metricSeriesLimits, "metric-series-limit", []string{}, "Maximum number of series of the metric of a map, further series are merged into an overflow series. Format is \"map_name,limit\"")
+	flags.StringVar(&opts.metricsExporter, "metrics-exporter", prometheusExporter, "How metrics are exported, one of \"prometheus\", \"otlp\", \"statsd\" or \"dogstatsd\"")
+	flags.StringVar(&opts.otlpEndpoint, "otlp-endpoint", "", "OTLP endpoint, host:port for grpc or a base URL for http/protobuf. Defaults to localhost:4317 or http://localhost:4318")
+	flags.StringVar(&opts.otlpProtocol, "otlp-protocol", "grpc", "OTLP protocol, one of \"grpc\" or \"http/protobuf\"")
+	flags.StringToStringVar(&opts.otlpHeaders, "otlp-headers", nil, "Headers sent with every OTLP export, e.g. \"authorization=Bearer token\"")
+	flags.BoolVar(&opts.otlpInsecure, "otlp-insecure", false, "Use plaintext instead of TLS for OTLP over grpc")
+	flags.DurationVar(&opts.otlpExportInterval, "otlp-export-interval", 15*time.Second, "How often metrics are exported over OTLP")
+	flags.StringToStringVar(&opts.otlpResourceAttributes, "otlp-resource-attributes", nil, "Attributes of the OTLP resource, e.g. \"k8s.cluster.name=prod\"")
+	flags.StringVar(&opts.statsdAddress, "statsd-address", "localhost:8125", "Address of the statsd agent")
+	flags.StringVar(&opts.statsdPrefix, "statsd-prefix", "", "Prefix of every statsd metric name. Defaults to the metrics namespace followed by a dot")
+	flags.IntVar(&opts.statsdMaxPacketSize, "statsd-max-packet-size", 1432, "Maximum size in bytes of a batch of statsd metrics")
+	flags.DurationVar(&opts.statsdFlushInterval, "statsd-flush-interval", time.Second, "How often a partial batch of statsd metrics is sent")
 }
 
 func Command(opts *options.GeneralOptions) *cobra.Command {
@@ -102,12 +201,27 @@ func run(cmd *cobra.Command, args []string, opts *runOptions) error {
 		return err
 	}
 	contextutils.LoggerFrom(ctx).Info("starting bee run")
+	outputs, err := parseOutputs(opts.outputs)
+	if err != nil {
+		return err
+	}
+	if hasOutput(outputs, outputTUI) {
+		if opts.notty {
+			return fmt.Errorf("the %s output can't be used with --no-tty", outputTUI)
+		}
+	} else if len(outputs) > 0 {
+		opts.notty = true
+	}
+	if hasOutput(outputs, outputJSON) {
+		// stdout only carries events
+		pterm.SetDefaultOutput(os.Stderr)
+	}
 	if opts.notty {
 		pterm.DisableStyling()
 	}
 
 	progLocation := args[0]
-	progReader, err := getProgram(ctx, opts.general, progLocation)
+	progReader, progDigest, err := getProgram(ctx, opts.general, progLocation)
 	if err != nil {
 		return err
 	}
@@ -117,14 +231,20 @@ func run(cmd *cobra.Command, args []string, opts *runOptions) error {
 		return fmt.Errorf("could not raise memory limit (check for sudo or setcap): %v", err)
 	}
 
-	promProvider, err := stats.NewPrometheusMetricsProvider(ctx, &stats.PrometheusOpts{Port: opts.promPort})
+	cfg, err := readRunConfig(opts.runConfig)
 	if err != nil {
 		return err
 	}
+	health := &stats.Health{}
+	metricsProvider, err := buildMetricsProvider(ctx, cfg, opts, health)
+	if err != nil {
+		return err
+	}
+	defer shutdownMetricsProvider(ctx, metricsProvider)
 
 	progLoader := loader.NewLoader(
 		decoder.NewDecoderFactory(),
-		promProvider,
+		metricsProvider,
 	)
 	parsedELF, err := progLoader.Parse(ctx, progReader)
 	if err != nil {
@@ -147,6 +267,7 @@ func run(cmd *cobra.Command, args []string, opts *runOptions) error {
 		Watcher:   tuiApp,
 		PinMaps:   opts.pinMaps,
 		PinProgs:  opts.pinProgs,
+		Health:    health,
 	}
 
 	// bail out before starting TUI if context canceled
@@ -154,9 +275,17 @@ func run(cmd *cobra.Command, args []string, opts *runOptions) error {
 		contextutils.LoggerFrom(ctx).Info("before calling tui.Run() context is done")
 		return ctx.Err()
 	}
+	if len(outputs) > 0 {
+		loaderOpts.EventWatcher, err = buildWatcher(ctx, outputs, opts, tuiApp, parsedELF, progLocation, progDigest)
+		if err != nil {
+			return err
+		}
+	}
 	if opts.notty {
-		fmt.Println("Calling Load...")
-		loaderOpts.Watcher = loader.NewNoopWatcher()
+		if len(outputs) == 0 {
+			fmt.Println("Calling Load...")
+			loaderOpts.Watcher = loader.NewNoopWatcher()
+		}
 		err = progLoader.Load(ctx, &loaderOpts)
 		return err
 	} else {
@@ -167,6 +296,106 @@ func run(cmd *cobra.Command, args []string, opts *runOptions) error {
 	}
 }
 
+// How long the metrics collected since the last send get to be sent on exit
+const metricsShutdownTimeout = 15 * time.Second
+
+// shutdownMetricsProvider waits for the providers which send metrics on their
+// own to send them once more, so that the end of the run isn't lost
+func shutdownMetricsProvider(ctx context.Context, provider stats.MetricsProvider) {
+	shutdowner, ok := provider.(stats.Shutdowner)
+	if !ok {
+		return
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	if err := shutdowner.Shutdown(shutdownCtx); err != nil {
+		contextutils.LoggerFrom(ctx).Errorf("could not send metrics on shutdown: %v", err)
+	}
+}
+
+func buildMetricsProvider(ctx context.Context, cfg *runConfig, opts *runOptions, health *stats.Health) (stats.MetricsProvider, error) {
+	relabelConfigs, err := buildRelabelConfigs(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := buildExporter(ctx, cfg, opts, health)
+	if err != nil {
+		return nil, err
+	}
+	if len(relabelConfigs) == 0 {
+		return provider, nil
+	}
+	return stats.NewRelabelingMetricsProvider(ctx, provider, relabelConfigs, opts.metricsSeriesTTL)
+}
+
+func buildExporter(ctx context.Context, cfg *runConfig, opts *runOptions, health *stats.Health) (stats.MetricsProvider, error) {
+	naming, err := buildNamingOpts(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.metricsExporter {
+	case prometheusExporter:
+		promOpts := &stats.PrometheusOpts{
+			ListenAddress:     opts.promListenAddress,
+			Port:              opts.promPort,
+			TLSCertFile:       opts.promTLSCert,
+			TLSKeyFile:        opts.promTLSKey,
+			ClientCAFile:      opts.promTLSClientCA,
+			BasicAuthUsername: opts.promBasicAuthUser,
+			EnablePprof:       opts.promPprof,
+			FailFast:          opts.promFailFast,
+			Health:            health,
+			Naming:            naming,
+			SeriesTTL:         opts.metricsSeriesTTL,
+		}
+		if opts.promBasicAuthUser != "" {
+			if opts.promBasicAuthPasswordFile == "" {
+				return nil, fmt.Errorf("--prom-basic-auth-user requires --prom-basic-auth-password-file")
+			}
+			password, err := os.ReadFile(opts.promBasicAuthPasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read basic auth password: %w", err)
+			}
+			promOpts.BasicAuthPassword = strings.TrimSpace(string(password))
+		}
+		if opts.promPush != "" {
+			promOpts.Push = &stats.PrometheusPushOpts{
+				Mode:     opts.promPush,
+				URL:      opts.promPushURL,
+				Headers:  opts.promPushHeaders,
+				Job:      opts.promPushJob,
+				Interval: opts.promPushInterval,
+			}
+		}
+		return stats.NewPrometheusMetricsProvider(ctx, promOpts)
+	case otlpExporter:
+		return stats.NewOTLPMetricsProvider(ctx, &stats.OTLPOpts{
+			Protocol:           opts.otlpProtocol,
+			Endpoint:           opts.otlpEndpoint,
+			Headers:            opts.otlpHeaders,
+			Insecure:           opts.otlpInsecure,
+			ExportInterval:     opts.otlpExportInterval,
+			ResourceAttributes: opts.otlpResourceAttributes,
+			Naming:             naming,
+			SeriesTTL:          opts.metricsSeriesTTL,
+		})
+	case statsdExporter, dogstatsdExporter:
+		return stats.NewStatsdMetricsProvider(ctx, &stats.StatsdOpts{
+			Address:       opts.statsdAddress,
+			Prefix:        opts.statsdPrefix,
+			DogStatsD:     opts.metricsExporter == dogstatsdExporter,
+			MaxPacketSize: opts.statsdMaxPacketSize,
+			FlushInterval: opts.statsdFlushInterval,
+			Naming:        naming,
+			SeriesTTL:     opts.metricsSeriesTTL,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported metrics exporter '%s', expected one of %s, %s, %s, %s",
+			opts.metricsExporter, prometheusExporter, otlpExporter, statsdExporter, dogstatsdExporter)
+	}
+}
+
 func buildTuiApp(loader *loader.Loader, progLocation string, filterString []string, parsedELF *loader.ParsedELF) (*tui.App, error) {
 	// TODO: add filter to UI
 	filter, err := tui.BuildFilter(filterString, parsedELF.WatchedMaps)
@@ -186,10 +415,11 @@ func getProgram(
 	ctx context.Context,
 	opts *options.GeneralOptions,
 	progLocation string,
-) (io.ReaderAt, error) {
+) (io.ReaderAt, string, error) {
 
 	var (
 		progReader     io.ReaderAt
+		progDigest     string
 		programSpinner *pterm.SpinnerPrinter
 	)
 	_, err := os.Stat(progLocation)
@@ -217,9 +447,10 @@ func getProgram(
 				}
 			}
 
-			return nil, err
+			return nil, "", err
 		}
 		progReader = bytes.NewReader(prog.ProgramFileBytes)
+		progDigest = prog.Digest.String()
 	} else {
 		programSpinner, _ = pterm.DefaultSpinner.Start(
 			fmt.Sprintf("Fetching program from file: %s", progLocation),
@@ -229,12 +460,12 @@ func getProgram(
 		if err != nil {
 			programSpinner.UpdateText("Failed to open BPF file")
 			programSpinner.Fail()
-			return nil, err
+			return nil, "", err
 		}
 	}
 	programSpinner.Success()
 
-	return progReader, nil
+	return progReader, progDigest, nil
 }
 
 func buildContext(ctx context.Context, debug bool) (context.Context, error) {
@@ -243,7 +474,7 @@ func buildContext(ctx context.Context, debug bool) (context.Context, error) {
 	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-stopper
-		fmt.Println("got sigterm or interrupt")
+		fmt.Fprintln(os.Stderr, "got sigterm or interrupt")
 		cancel()
 	}()
 
@@ -293,6 +524,77 @@ func parseWatchMapOptions(runOpts *runOptions) (map[string]loader.WatchedMapOpti
 		watchMapOptions[mapName] = w
 	}
 
+	for _, key := range runOpts.valueKey {
+		split := strings.Index(key, ",")
+		if split == -1 {
+			return nil, fmt.Errorf("could not parse value-key: %s", key)
+		}
+		mapName := key[:split]
+		w := watchMapOptions[mapName]
+		w.ValueKey = key[split+1:]
+		watchMapOptions[mapName] = w
+	}
+
+	for _, observe := range runOpts.histObserve {
+		split := strings.Index(observe, ",")
+		if split == -1 {
+			return nil, fmt.Errorf("could not parse hist-observe: %s", observe)
+		}
+		mapName := observe[:split]
+		mode := observe[split+1:]
+		if mode != loader.HistObserveValue && mode != loader.HistObserveDelta {
+			return nil, fmt.Errorf("could not parse hist-observe: %s, expected one of %s, %s", observe, loader.HistObserveValue, loader.HistObserveDelta)
+		}
+		w := watchMapOptions[mapName]
+		w.HistObserve = mode
+		watchMapOptions[mapName] = w
+	}
+
+	for _, histType := range runOpts.histType {
+		split := strings.Index(histType, ",")
+		if split == -1 {
+			return nil, fmt.Errorf("could not parse hist-type: %s", histType)
+		}
+		mapName := histType[:split]
+		kind := histType[split+1:]
+		if kind != loader.HistTypeBuckets && kind != loader.HistTypeNative && kind != loader.HistTypeSummary {
+			return nil, fmt.Errorf("could not parse hist-type: %s, expected one of %s, %s, %s", histType, loader.HistTypeBuckets, loader.HistTypeNative, loader.HistTypeSummary)
+		}
+		w := watchMapOptions[mapName]
+		w.HistType = kind
+		watchMapOptions[mapName] = w
+	}
+
+	for _, factor := range runOpts.histFactor {
+		split := strings.Index(factor, ",")
+		if split == -1 {
+			return nil, fmt.Errorf("could not parse hist-bucket-factor: %s", factor)
+		}
+		mapName := factor[:split]
+		value, err := strconv.ParseFloat(factor[split+1:], 64)
+		if err != nil || value <= 1 {
+			return nil, fmt.Errorf("could not parse hist-bucket-factor: %s, expected a number above 1", factor)
+		}
+		w := watchMapOptions[mapName]
+		w.HistBucketFactor = value
+		watchMapOptions[mapName] = w
+	}
+
+	for _, quantiles := range runOpts.quantiles {
+		mapName, values, err := parseBucket(quantiles)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse summary-quantiles: %w", err)
+		}
+		for _, q := range values {
+			if q <= 0 || q >= 1 {
+				return nil, fmt.Errorf("could not parse summary-quantiles: %s, quantiles must be between 0 and 1", quantiles)
+			}
+		}
+		w := watchMapOptions[mapName]
+		w.SummaryQuantiles = values
+		watchMapOptions[mapName] = w
+	}
+
 	return watchMapOptions, nil
 }
 
@@ -0,0 +1,74 @@
+package decoder
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How often the offset between a kernel clock and the realtime clock is re-measured.
+// The offset drifts as NTP adjusts the realtime clock, and jumps when the
+// realtime clock is set or, for CLOCK_MONOTONIC, when the host suspends.
+const clockRefreshInterval = time.Minute
+
+var (
+	// Clock used by bpf_ktime_get_ns()
+	monotonicClock = newKernelClock(unix.CLOCK_MONOTONIC)
+	// Clock used by bpf_ktime_get_boot_ns()
+	boottimeClock = newKernelClock(unix.CLOCK_BOOTTIME)
+)
+
+// kernelClock converts timestamps taken from a kernel clock into wall clock time.
+type kernelClock struct {
+	clockID int32
+	// Sources of the clocks, replaced in tests
+	clockGettime func(clockID int32, ts *unix.Timespec) error
+	now          func() time.Time
+
+	mu sync.Mutex
+	// realtime - kernel clock, in ns
+	offset   int64
+	measured time.Time
+}
+
+func newKernelClock(clockID int32) *kernelClock {
+	c := &kernelClock{
+		clockID:      clockID,
+		clockGettime: unix.ClockGettime,
+		now:          time.Now,
+	}
+	c.measure()
+	return c
+}
+
+func (c *kernelClock) toTime(val interface{}) (time.Time, error) {
+	ns, err := toUint64(val)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c.mu.Lock()
+	if c.now().Sub(c.measured) > clockRefreshInterval {
+		c.measure()
+	}
+	offset := c.offset
+	c.mu.Unlock()
+
+	return time.Unix(0, int64(ns)+offset), nil
+}
+
+// measure must be called with c.mu held, or before c is shared
+func (c *kernelClock) measure() {
+	var before, kernel, after unix.Timespec
+	// Reading the realtime clock on both sides of the kernel clock and
+	// taking the midpoint keeps the error within the time between the reads.
+	if c.clockGettime(unix.CLOCK_REALTIME, &before) != nil ||
+		c.clockGettime(c.clockID, &kernel) != nil ||
+		c.clockGettime(unix.CLOCK_REALTIME, &after) != nil {
+		return
+	}
+	realtime := before.Nano() + (after.Nano()-before.Nano())/2
+	c.offset = realtime - kernel.Nano()
+	c.measured = c.now()
+}
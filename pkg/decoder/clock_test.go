@@ -0,0 +1,63 @@
+package decoder
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeClocks stands in for the realtime and monotonic clocks of the host
+type fakeClocks struct {
+	realtime  int64
+	monotonic int64
+	now       time.Time
+}
+
+func (f *fakeClocks) clockGettime(clockID int32, ts *unix.Timespec) error {
+	switch clockID {
+	case unix.CLOCK_REALTIME:
+		*ts = unix.NsecToTimespec(f.realtime)
+	default:
+		*ts = unix.NsecToTimespec(f.monotonic)
+	}
+	return nil
+}
+
+func TestKernelClock(t *testing.T) {
+	booted := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	clocks := &fakeClocks{
+		realtime:  booted.Add(time.Hour).UnixNano(),
+		monotonic: int64(time.Hour),
+		now:       booted.Add(time.Hour),
+	}
+	c := &kernelClock{
+		clockID:      unix.CLOCK_MONOTONIC,
+		clockGettime: clocks.clockGettime,
+		now:          func() time.Time { return clocks.now },
+	}
+	c.measure()
+
+	converted, err := c.toTime(uint64(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := booted.Add(2 * time.Hour); !converted.Equal(expected) {
+		t.Errorf("expected %s, found %s", expected, converted)
+	}
+
+	// the realtime clock is set back a second, the offset is kept until it is measured again
+	clocks.realtime -= int64(time.Second)
+	clocks.now = clocks.now.Add(30 * time.Second)
+	if converted, _ = c.toTime(uint64(2 * time.Hour)); !converted.Equal(booted.Add(2 * time.Hour)) {
+		t.Errorf("expected the offset not to be measured again within a minute, found %s", converted)
+	}
+	clocks.now = clocks.now.Add(31 * time.Second)
+	if converted, _ = c.toTime(uint64(2 * time.Hour)); !converted.Equal(booted.Add(2*time.Hour - time.Second)) {
+		t.Errorf("expected the offset to be measured again after a minute, found %s", converted)
+	}
+
+	if _, err := c.toTime("2h"); err == nil {
+		t.Errorf("expected an error converting a string")
+	}
+}
@@ -3,19 +3,43 @@ package decoder
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/cilium/ebpf/btf"
 )
 
 const (
-	ipv4AddrTypeName = "ipv4_addr"
-	ipv6AddrTypeName = "ipv6_addr"
-	durationTypeName = "duration"
+	ipv4AddrTypeName  = "ipv4_addr"
+	ipv6AddrTypeName  = "ipv6_addr"
+	durationTypeName  = "duration"
+	byteCountTypeName = "byte_count"
+	pidTypeName       = "bee_pid"
+	uidTypeName       = "bee_uid"
+	gidTypeName       = "bee_gid"
+	errnoTypeName     = "bee_errno"
+	syscallTypeName   = "bee_syscall_nr"
+	ifindexTypeName   = "bee_ifindex"
+	cgroupTypeName    = "bee_cgroup_id"
+	ktimeTypeName     = "ktime"
+	boottimeTypeName  = "boottime"
+
+	numericCharTypeName = "numeric_char"
+	textCharTypeName    = "text_char"
+
+	// Suffix of the member which holds the length of an array member
+	lengthMemberSuffix = "_len"
+)
+
+const (
+	// Raw values of duration fields are nanoseconds
+	UnitNanoseconds = "nanoseconds"
+	// Raw values of byte_count fields are bytes
+	UnitBytes = "bytes"
 )
 
 type BinaryDecoder interface {
@@ -25,6 +49,9 @@ type BinaryDecoder interface {
 	DecodeBtfBinary(
 		ctx context.Context, typ btf.Type, raw []byte,
 	) (map[string]interface{}, error)
+	// CompilePlan walks a btf type once and returns a Plan which decodes
+	// raw binary data of that type in the same format as DecodeBtfBinary.
+	CompilePlan(typ btf.Type) (*Plan, error)
 }
 
 type DecoderFactory func() BinaryDecoder
@@ -34,243 +61,421 @@ func NewDecoderFactory() DecoderFactory {
 }
 
 func newDecoder() BinaryDecoder {
-	return &decoder{}
+	return &decoder{
+		host:  defaultHostResolver,
+		plans: map[btf.Type]*Plan{},
+	}
 }
 
 type decoder struct {
-	// Offset within the buffer from which we are currently reading
-	offset uint32
-	// Raw binary bytes to read from
-	raw []byte
+	// Resolves host ids such as pids and uids into names
+	host *hostResolver
+	// Plans compiled by DecodeBtfBinary, so each type is only walked once
+	plansMu sync.Mutex
+	plans   map[btf.Type]*Plan
 }
 
 func (d *decoder) DecodeBtfBinary(
 	ctx context.Context, typ btf.Type, raw []byte,
 ) (map[string]interface{}, error) {
-	// Reset values when called
-	d.raw = raw
-	d.offset = 0
+	plan, err := d.cachedPlan(typ)
+	if err != nil {
+		return nil, err
+	}
+	// The caller owns the result, so it must not come from the plan's pool
+	result := make(map[string]interface{}, len(plan.fields))
+	if err := plan.decodeInto(result, raw); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// cachedPlan returns the plan of typ, compiling it on first use. A decoder
+// may be shared by several goroutines, so the cache is locked.
+func (d *decoder) cachedPlan(typ btf.Type) (*Plan, error) {
+	d.plansMu.Lock()
+	defer d.plansMu.Unlock()
+	if plan, ok := d.plans[typ]; ok {
+		return plan, nil
+	}
+	plan, err := d.CompilePlan(typ)
+	if err != nil {
+		return nil, err
+	}
+	d.plans[typ] = plan
+	return plan, nil
+}
 
+func (d *decoder) CompilePlan(typ btf.Type) (*Plan, error) {
+	plan := &Plan{}
 	switch typedBtf := typ.(type) {
 	case *btf.Struct:
-		// Parse the ringbuf event entry into an Event structure.
-		// buf := bytes.NewBuffer(raw)
-		result := make(map[string]interface{})
+		members := make(map[string]btf.Member, len(typedBtf.Members))
 		for _, member := range typedBtf.Members {
-			val, err := d.processSingleType(member.Type)
+			members[member.Name] = member
+		}
+		for i, member := range typedBtf.Members {
+			if member.BitfieldSize != 0 {
+				return nil, fmt.Errorf("bitfield member '%s' is not supported", member.Name)
+			}
+			field, err := d.compileField(member.Name, member.Offset.Bytes(), member.Type)
 			if err != nil {
 				return nil, err
 			}
-			result[member.Name] = val
+			if field.offset+field.size > typedBtf.Size {
+				return nil, fmt.Errorf("member '%s' at offset %d does not fit in struct of %d bytes", member.Name, field.offset, typedBtf.Size)
+			}
+			if array, ok := member.Type.(*btf.Array); ok {
+				// A flexible array member takes up the rest of the record
+				if array.Nelems == 0 {
+					if i != len(typedBtf.Members)-1 {
+						return nil, fmt.Errorf("flexible array member '%s' must be the last member", member.Name)
+					}
+					field.flexible = true
+				}
+				// <name>_len holds the number of elements of <name> which are set
+				if lenMember, ok := members[member.Name+lengthMemberSuffix]; ok {
+					field.length, err = compileLength(lenMember)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			plan.fields = append(plan.fields, field)
 		}
-		return result, nil
-	case *btf.Typedef:
-		val, err := d.processSingleType(typedBtf)
+		plan.size = typedBtf.Size
+	case *btf.Typedef, *btf.Float, *btf.Int:
+		field, err := d.compileField("", 0, typedBtf)
 		if err != nil {
 			return nil, err
 		}
-		return map[string]interface{}{"": val}, nil
+		plan.fields = append(plan.fields, field)
+		plan.size = field.size
+	default:
+		return nil, fmt.Errorf("unsupported type, %s", typedBtf.TypeName())
+	}
+	return plan, nil
+}
+
+func (d *decoder) compileField(name string, offset uint32, typ btf.Type) (fieldPlan, error) {
+	size, err := btf.Sizeof(typ)
+	if err != nil {
+		return fieldPlan{}, err
+	}
+	decode, err := d.compileType(typ)
+	if err != nil {
+		return fieldPlan{}, err
+	}
+	field := fieldPlan{
+		name:   name,
+		offset: offset,
+		size:   uint32(size),
+		decode: decode,
+	}
+	if typedef, ok := typ.(*btf.Typedef); ok {
+		field.typedef = typedef.Name
+	}
+	field.kind = kindOf(typ)
+	return field, nil
+}
+
+// kindOf returns the kind of the values compileType decodes typ to
+func kindOf(typ btf.Type) Kind {
+	switch typed := typ.(type) {
+	case *btf.Int:
+		switch {
+		case typed.Name == "char" || typed.Encoding == btf.Char:
+			return KindString
+		case typed.Encoding == btf.Bool:
+			return KindBool
+		case typed.Encoding == btf.Signed:
+			return KindInt
+		default:
+			return KindUint
+		}
 	case *btf.Float:
-		val, err := d.processSingleType(typedBtf)
-		if err != nil {
-			return nil, err
+		return KindFloat
+	case *btf.Array:
+		elemType := typed.Type
+		if typedef, ok := elemType.(*btf.Typedef); ok {
+			elemType, _ = getUnderlyingType(typedef)
 		}
-		return map[string]interface{}{"": val}, nil
-	case *btf.Int:
-		val, err := d.processSingleType(typedBtf)
+		if elem, ok := elemType.(*btf.Int); ok && elem.Name == "unsigned char" {
+			return KindBytes
+		}
+		return KindString
+	case *btf.Typedef:
+		if _, ok := lookupTypedef(typed.Name); ok {
+			return KindUnknown
+		}
+		switch typed.Name {
+		case durationTypeName:
+			return KindDuration
+		case ktimeTypeName, boottimeTypeName:
+			return KindTime
+		case ipv4AddrTypeName, ipv6AddrTypeName, pidTypeName, uidTypeName, gidTypeName,
+			errnoTypeName, syscallTypeName, ifindexTypeName, cgroupTypeName, textCharTypeName:
+			return KindString
+		}
+		underlying, err := getUnderlyingType(typed)
 		if err != nil {
-			return nil, err
+			return KindUnknown
 		}
-		return map[string]interface{}{"": val}, nil
-	default:
-		return nil, fmt.Errorf("unsupported type, %s", typedBtf.TypeName())
+		// numeric_char is decoded as the integer underneath
+		return kindOf(underlying)
 	}
+	return KindUnknown
 }
 
-func (d *decoder) processSingleType(typ btf.Type) (interface{}, error) {
+func (d *decoder) compileType(typ btf.Type) (decodeFunc, error) {
 	switch typedMember := typ.(type) {
 	case *btf.Int:
 		switch typedMember.Encoding {
 		case btf.Signed:
+			// Plain char is text, while signed char (i.e. s8) is a small integer
 			if typedMember.Name == "char" {
-				return d.handleChar(typedMember)
+				return decodeChar, nil
 			}
-			return d.handleInt(typedMember)
+			return intDecoder(typedMember)
 		case btf.Bool:
-			// TODO
-			return false, nil
+			return decodeBool, nil
 		case btf.Char:
-			// TODO
-			return "", nil
+			return decodeChar, nil
 		default:
-			if typedMember.Name == "unsigned char" {
-				return d.handleChar(typedMember)
+			// Plain char may be unsigned depending on the target, while
+			// unsigned char (i.e. u8) is a small integer
+			if typedMember.Name == "char" {
+				return decodeChar, nil
 			}
 			// Default encoding seems to be unsigned
-			return d.handleUint(typedMember)
+			return uintDecoder(typedMember)
 		}
 	case *btf.Typedef:
+		if decode, ok := lookupTypedef(typedMember.Name); ok {
+			return decodeFunc(decode), nil
+		}
 		// Handle special types
 		underlying, err := getUnderlyingType(typedMember)
 		if err != nil {
 			return nil, err
 		}
-		processed, err := d.processSingleType(underlying)
+		switch typedMember.Name {
+		case numericCharTypeName, textCharTypeName:
+			return charDecoder(underlying, typedMember.Name == numericCharTypeName)
+		}
+		decode, err := d.compileType(underlying)
 		if err != nil {
 			return nil, err
 		}
-
-		switch typedMember.Name {
-		case durationTypeName:
-			return u64ToDuration(processed)
-		case ipv4AddrTypeName:
-			return u32ToIp(processed)
-		case ipv6AddrTypeName:
-			return u32ToIp(processed)
-		default:
-			return processed, nil
+		convert := d.typedefConverter(typedMember.Name)
+		if convert == nil {
+			return decode, nil
 		}
-
+		return func(raw []byte) (interface{}, error) {
+			processed, err := decode(raw)
+			if err != nil {
+				return nil, err
+			}
+			return convert(processed)
+		}, nil
 	case *btf.Float:
-		return d.handleFloat(typedMember)
+		return floatDecoder(typedMember)
 	case *btf.Array:
-		return d.handleArray(typedMember)
+		return arrayDecoder(typedMember)
 	default:
 		return nil, fmt.Errorf("attempting to decode unsupported type, found: %s", typ.TypeName())
 	}
 }
 
-// currently only supports strings represented as char arrays
-func (d *decoder) handleArray(
+// typedefConverter returns the conversion applied to values of the special typedef
+// with the given name, or nil if the typedef has no special meaning
+func (d *decoder) typedefConverter(name string) func(interface{}) (interface{}, error) {
+	switch name {
+	case durationTypeName:
+		return func(val interface{}) (interface{}, error) { return u64ToDuration(val) }
+	case ipv4AddrTypeName:
+		return func(val interface{}) (interface{}, error) { return u32ToIp(val) }
+	case ipv6AddrTypeName:
+		return func(val interface{}) (interface{}, error) { return u32ToIp(val) }
+	case pidTypeName:
+		return func(val interface{}) (interface{}, error) { return d.host.pid(val) }
+	case uidTypeName:
+		return func(val interface{}) (interface{}, error) { return d.host.user(val) }
+	case gidTypeName:
+		return func(val interface{}) (interface{}, error) { return d.host.group(val) }
+	case errnoTypeName:
+		return func(val interface{}) (interface{}, error) { return toErrno(val) }
+	case syscallTypeName:
+		return func(val interface{}) (interface{}, error) { return toSyscall(val) }
+	case ifindexTypeName:
+		return func(val interface{}) (interface{}, error) { return d.host.ifindex(val) }
+	case cgroupTypeName:
+		return func(val interface{}) (interface{}, error) { return d.host.cgroup(val) }
+	case ktimeTypeName:
+		return func(val interface{}) (interface{}, error) { return monotonicClock.toTime(val) }
+	case boottimeTypeName:
+		return func(val interface{}) (interface{}, error) { return boottimeClock.toTime(val) }
+	default:
+		return nil
+	}
+}
+
+// compileLength returns where to read the length of an array from
+func compileLength(member btf.Member) (*lengthPlan, error) {
+	typ := member.Type
+	if typedef, ok := typ.(*btf.Typedef); ok {
+		var err error
+		if typ, err = getUnderlyingType(typedef); err != nil {
+			return nil, err
+		}
+	}
+	typInt, ok := typ.(*btf.Int)
+	if !ok || member.BitfieldSize != 0 {
+		return nil, fmt.Errorf("length member '%s' must be an integer", member.Name)
+	}
+	switch typInt.Size {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("unsupported integer size %d for length member '%s'", typInt.Size, member.Name)
+	}
+	return &lengthPlan{
+		offset: member.Offset.Bytes(),
+		size:   typInt.Size,
+	}, nil
+}
+
+// currently only supports strings represented as char arrays, and bytes
+// represented as unsigned char (i.e. u8) arrays.
+// raw is the part of the array which is set, which is the whole array unless
+// the array has a length member or is a flexible array member.
+func arrayDecoder(
 	typedMember *btf.Array,
-) (interface{}, error) {
-	typInt, ok := typedMember.Type.(*btf.Int)
+) (decodeFunc, error) {
+	elemType := typedMember.Type
+	if typedef, ok := elemType.(*btf.Typedef); ok {
+		var err error
+		if elemType, err = getUnderlyingType(typedef); err != nil {
+			return nil, err
+		}
+	}
+	typInt, ok := elemType.(*btf.Int)
 	if !ok {
 		return nil, errors.New("only arrays of type *btf.Int (e.g. chars) are supported")
 	}
-	if typInt.Name != "char" {
-		return nil, fmt.Errorf("only arrays with chars (i.e. strings) are supported, found '%s'", typInt.Name)
-	}
 	if typInt.Size != 1 {
 		return nil, fmt.Errorf("expected type size of 1 byte, found '%v'", typInt.Size)
 	}
-	length := int(typedMember.Nelems)
-	slice := make([]byte, length)
-	for i := 0; i < length; i++ {
-		buf := bytes.NewBuffer(d.raw[d.offset : d.offset+typInt.Size])
-		d.offset += typInt.Size
-		var val byte
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		slice[i] = val
+	switch typInt.Name {
+	case "char":
+		return func(raw []byte) (interface{}, error) {
+			// A string filling the whole array has no NUL terminator
+			n := bytes.IndexByte(raw, 0)
+			if n == -1 {
+				n = len(raw)
+			}
+			return string(raw[:n]), nil
+		}, nil
+	case "unsigned char":
+		return func(raw []byte) (interface{}, error) {
+			// raw belongs to the record being decoded
+			return append([]byte(nil), raw...), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("only arrays with chars (i.e. strings) or unsigned chars (i.e. bytes) are supported, found '%s'", typInt.Name)
 	}
-	n := bytes.IndexByte(slice, 0)
-	str := string(slice[:n])
-	return str, nil
 }
 
-func (d *decoder) handleFloat(
+func floatDecoder(
 	typedMember *btf.Float,
-) (interface{}, error) {
-	buf := bytes.NewBuffer(d.raw[d.offset : d.offset+typedMember.Size])
-	d.offset += typedMember.Size
+) (decodeFunc, error) {
 	switch typedMember.Size {
 	case 8:
-		var val float64
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return math.Float64frombits(Endianess.Uint64(raw)), nil
+		}, nil
 	case 4:
-		var val float32
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return math.Float32frombits(Endianess.Uint32(raw)), nil
+		}, nil
 	}
-	return nil, errors.New("this should never happen")
+	return nil, fmt.Errorf("unsupported float size %d", typedMember.Size)
 }
 
-func (d *decoder) handleUint(
+func uintDecoder(
 	typedMember *btf.Int,
-) (interface{}, error) {
-	// Default encoding seems to be unsigned
-	buf := bytes.NewBuffer(d.raw[d.offset : d.offset+typedMember.Size])
-	d.offset += typedMember.Size
+) (decodeFunc, error) {
 	switch typedMember.Size * 8 {
 	case 64:
-		var val uint64
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return Endianess.Uint64(raw), nil
+		}, nil
 	case 32:
-		var val uint32
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return Endianess.Uint32(raw), nil
+		}, nil
 	case 16:
-		var val uint16
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return Endianess.Uint16(raw), nil
+		}, nil
 	case 8:
-		var val uint8
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return raw[0], nil
+		}, nil
 	}
-	return nil, errors.New("this should never happen")
+	return nil, fmt.Errorf("unsupported integer size %d", typedMember.Size)
 }
 
-func (d *decoder) handleChar(
-	typedMember *btf.Int,
-) (interface{}, error) {
-	buf := bytes.NewBuffer(d.raw[d.offset : d.offset+1])
-	d.offset += 1
-	var val byte
-	if err := binary.Read(buf, Endianess, &val); err != nil {
-		return nil, err
+func decodeChar(raw []byte) (interface{}, error) {
+	return string(raw[:1]), nil
+}
+
+// charDecoder decodes any char type either as a character or as a small
+// integer, regardless of how it would be decoded by default
+func charDecoder(typ btf.Type, numeric bool) (decodeFunc, error) {
+	typInt, ok := typ.(*btf.Int)
+	if !ok || typInt.Size != 1 {
+		return nil, fmt.Errorf("expected a 1 byte integer for char typedef, found %s", typ.TypeName())
+	}
+	if !numeric {
+		return decodeChar, nil
+	}
+	if typInt.Encoding == btf.Signed {
+		return intDecoder(typInt)
 	}
-	return string([]byte{val}), nil
+	return uintDecoder(typInt)
 }
 
-func (d *decoder) handleInt(
+func decodeBool(raw []byte) (interface{}, error) {
+	for _, b := range raw {
+		if b != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func intDecoder(
 	typedMember *btf.Int,
-) (interface{}, error) {
-	buf := bytes.NewBuffer(d.raw[d.offset : d.offset+typedMember.Size])
-	d.offset += typedMember.Size
+) (decodeFunc, error) {
 	switch typedMember.Size * 8 {
 	case 64:
-		var val int64
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return int64(Endianess.Uint64(raw)), nil
+		}, nil
 	case 32:
-		var val int32
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return int32(Endianess.Uint32(raw)), nil
+		}, nil
 	case 16:
-		var val int16
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return int16(Endianess.Uint16(raw)), nil
+		}, nil
 	case 8:
-		var val int8
-		if err := binary.Read(buf, Endianess, &val); err != nil {
-			return nil, err
-		}
-		return val, nil
+		return func(raw []byte) (interface{}, error) {
+			return int8(raw[0]), nil
+		}, nil
 	}
-	return nil, errors.New("this should never happen")
+	return nil, fmt.Errorf("unsupported integer size %d", typedMember.Size)
 }
 
 func getUnderlyingType(tf *btf.Typedef) (btf.Type, error) {
@@ -301,3 +506,43 @@ func u32ToIp(val interface{}) (net.IP, error) {
 	Endianess.PutUint32(ip, u32Val)
 	return ip, nil
 }
+
+// toUint64 widens any of the integer types produced by the decoder to a uint64
+func toUint64(val interface{}) (uint64, error) {
+	switch v := val.(type) {
+	case uint64:
+		return v, nil
+	case uint32:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case int64:
+		return uint64(v), nil
+	case int32:
+		return uint64(v), nil
+	case int16:
+		return uint64(v), nil
+	case int8:
+		return uint64(v), nil
+	}
+	return 0, fmt.Errorf("expected an integer, found %T", val)
+}
+
+func toErrno(val interface{}) (Errno, error) {
+	u64Val, err := toUint64(val)
+	if err != nil {
+		return 0, err
+	}
+	// truncating keeps the sign of negative s32/s64 errnos
+	return Errno(int32(u64Val)), nil
+}
+
+func toSyscall(val interface{}) (Syscall, error) {
+	u64Val, err := toUint64(val)
+	if err != nil {
+		return 0, err
+	}
+	return Syscall(u64Val), nil
+}
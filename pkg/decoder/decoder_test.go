@@ -0,0 +1,341 @@
+package decoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+var (
+	u32Type = &btf.Int{Name: "unsigned int", Size: 4}
+	u64Type = &btf.Int{Name: "unsigned long long", Size: 8}
+	s32Type = &btf.Int{Name: "int", Size: 4, Encoding: btf.Signed}
+
+	charType = &btf.Int{Name: "char", Size: 1, Encoding: btf.Signed}
+
+	ipv4Type     = &btf.Typedef{Name: ipv4AddrTypeName, Type: u32Type}
+	durationType = &btf.Typedef{Name: durationTypeName, Type: u64Type}
+)
+
+// event mirrors a typical ring buffer struct:
+//
+//	struct event_t {
+//		ipv4_addr saddr;
+//		ipv4_addr daddr;
+//		u32 pid;
+//		s32 ret;
+//		duration latency;
+//		u64 bytes;
+//		char comm[16];
+//	} __attribute__((packed));
+var eventType = &btf.Struct{
+	Name: "event_t",
+	Size: 48,
+	Members: []btf.Member{
+		{Name: "saddr", Type: ipv4Type, Offset: 0},
+		{Name: "daddr", Type: ipv4Type, Offset: 32},
+		{Name: "pid", Type: u32Type, Offset: 64},
+		{Name: "ret", Type: s32Type, Offset: 96},
+		{Name: "latency", Type: durationType, Offset: 128},
+		{Name: "bytes", Type: u64Type, Offset: 192},
+		{Name: "comm", Type: &btf.Array{Type: charType, Nelems: 16}, Offset: 256},
+	},
+}
+
+func eventRecord() []byte {
+	raw := make([]byte, 48)
+	copy(raw[0:4], []byte{10, 0, 0, 1})
+	copy(raw[4:8], []byte{1, 1, 1, 1})
+	Endianess.PutUint32(raw[8:12], 1234)
+	Endianess.PutUint32(raw[12:16], uint32(0xfffffffe)) // -2
+	Endianess.PutUint64(raw[16:24], 1500)
+	Endianess.PutUint64(raw[24:32], 4096)
+	copy(raw[32:48], "curl")
+	return raw
+}
+
+func TestDecodeBtfBinaryStruct(t *testing.T) {
+	d := newDecoder()
+	result, err := d.DecodeBtfBinary(context.Background(), eventType, eventRecord())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"saddr":   "10.0.0.1",
+		"daddr":   "1.1.1.1",
+		"pid":     "1234",
+		"ret":     "-2",
+		"latency": "1.5µs",
+		"bytes":   "4096",
+		"comm":    "curl",
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("expected %d fields, found %d: %v", len(expected), len(result), result)
+	}
+	for k, v := range expected {
+		if got := fmt.Sprint(result[k]); got != v {
+			t.Errorf("field %s: expected %q, found %q", k, v, got)
+		}
+	}
+}
+
+func TestDecodeBtfBinaryScalar(t *testing.T) {
+	d := newDecoder()
+	raw := make([]byte, 8)
+	Endianess.PutUint64(raw, 42)
+	result, err := d.DecodeBtfBinary(context.Background(), u64Type, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result[""] != uint64(42) {
+		t.Fatalf("expected 42, found %v", result[""])
+	}
+}
+
+func TestRegisterTypedef(t *testing.T) {
+	tenants := map[uint32]string{7: "acme"}
+	RegisterTypedef("tenant_id", func(raw []byte) (interface{}, error) {
+		id := Endianess.Uint32(raw)
+		if name, ok := tenants[id]; ok {
+			return name, nil
+		}
+		return fmt.Sprint(id), nil
+	})
+	t.Cleanup(func() { unregisterTypedef("tenant_id") })
+
+	tenantType := &btf.Struct{
+		Name: "key_t",
+		Size: 8,
+		Members: []btf.Member{
+			{Name: "tenant", Type: &btf.Typedef{Name: "tenant_id", Type: u32Type}, Offset: 0},
+			{Name: "pid", Type: u32Type, Offset: 32},
+		},
+	}
+	raw := make([]byte, 8)
+	Endianess.PutUint32(raw[0:4], 7)
+	Endianess.PutUint32(raw[4:8], 1234)
+
+	result, err := newDecoder().DecodeBtfBinary(context.Background(), tenantType, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result["tenant"] != "acme" {
+		t.Fatalf("expected tenant to be decoded by the registered decoder, found %v", result["tenant"])
+	}
+	if result["pid"] != uint32(1234) {
+		t.Fatalf("expected pid 1234, found %v", result["pid"])
+	}
+}
+
+func TestDecodeBtfBinaryTrailingPayload(t *testing.T) {
+	u8 := &btf.Typedef{Name: "u8", Type: &btf.Int{Name: "unsigned char", Size: 1}}
+	// struct {
+	//	u32 pid;
+	//	u16 data_len;
+	//	u8 data[4];
+	//	char path[];
+	// };
+	payloadType := &btf.Struct{
+		Name: "payload_t",
+		Size: 12,
+		Members: []btf.Member{
+			{Name: "pid", Type: u32Type, Offset: 0},
+			{Name: "data_len", Type: &btf.Int{Name: "unsigned short", Size: 2}, Offset: 32},
+			{Name: "data", Type: &btf.Array{Type: u8, Nelems: 4}, Offset: 48},
+			{Name: "path", Type: &btf.Array{Type: charType, Nelems: 0}, Offset: 96},
+		},
+	}
+	raw := make([]byte, 12)
+	Endianess.PutUint32(raw[0:4], 1234)
+	Endianess.PutUint16(raw[4:6], 2)
+	copy(raw[6:10], []byte{0xde, 0xad, 0xbe, 0xef})
+	raw = append(raw, "/etc/passwd"...)
+
+	result, err := newDecoder().DecodeBtfBinary(context.Background(), payloadType, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data := result["data"].([]byte); !bytes.Equal(data, []byte{0xde, 0xad}) {
+		t.Fatalf("expected data to be cut to data_len, found %x", data)
+	}
+	if result["path"] != "/etc/passwd" {
+		t.Fatalf("expected path to hold the rest of the record, found %q", result["path"])
+	}
+}
+
+func TestDecodeBtfBinaryChars(t *testing.T) {
+	charsType := &btf.Struct{
+		Name: "chars_t",
+		Size: 6,
+		Members: []btf.Member{
+			{Name: "flag", Type: &btf.Int{Name: "_Bool", Size: 1, Encoding: btf.Bool}, Offset: 0},
+			{Name: "letter", Type: charType, Offset: 8},
+			{Name: "s8", Type: &btf.Int{Name: "signed char", Size: 1, Encoding: btf.Signed}, Offset: 16},
+			{Name: "u8", Type: &btf.Int{Name: "unsigned char", Size: 1}, Offset: 24},
+			{Name: "num", Type: &btf.Typedef{Name: numericCharTypeName, Type: charType}, Offset: 32},
+			{Name: "text", Type: &btf.Typedef{Name: textCharTypeName, Type: &btf.Int{Name: "unsigned char", Size: 1}}, Offset: 40},
+		},
+	}
+	raw := []byte{1, 'a', 0xff, 200, 'b', 'c'}
+
+	result, err := newDecoder().DecodeBtfBinary(context.Background(), charsType, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"flag":   true,
+		"letter": "a",
+		"s8":     int8(-1),
+		"u8":     uint8(200),
+		"num":    int8('b'),
+		"text":   "c",
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("field %s: expected %#v, found %#v", k, v, result[k])
+		}
+	}
+}
+
+func TestDecodeBtfBinaryShortRecord(t *testing.T) {
+	d := newDecoder()
+	_, err := d.DecodeBtfBinary(context.Background(), eventType, eventRecord()[:20])
+	if !errors.Is(err, ErrShortRecord) {
+		t.Fatalf("expected ErrShortRecord, found %v", err)
+	}
+}
+
+func TestDecodeBtfBinaryUnterminatedString(t *testing.T) {
+	d := newDecoder()
+	raw := eventRecord()
+	copy(raw[32:48], "0123456789abcdef")
+	result, err := d.DecodeBtfBinary(context.Background(), eventType, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result["comm"] != "0123456789abcdef" {
+		t.Fatalf("expected the whole array, found %q", result["comm"])
+	}
+}
+
+func FuzzDecodeBtfBinary(f *testing.F) {
+	f.Add(eventRecord())
+	f.Add(eventRecord()[:20])
+	f.Add([]byte{})
+	f.Add(make([]byte, 64))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		d := newDecoder()
+		result, err := d.DecodeBtfBinary(context.Background(), eventType, raw)
+		if len(raw) < int(eventType.Size) {
+			if !errors.Is(err, ErrShortRecord) {
+				t.Fatalf("expected ErrShortRecord for %d bytes, found %v", len(raw), err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result) != len(eventType.Members) {
+			t.Fatalf("expected %d fields, found %d", len(eventType.Members), len(result))
+		}
+	})
+}
+
+func TestDecodeBtfBinaryConcurrent(t *testing.T) {
+	d := newDecoder()
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := d.DecodeBtfBinary(context.Background(), eventType, eventRecord())
+			errs <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func BenchmarkDecodeBtfBinary(b *testing.B) {
+	ctx := context.Background()
+	d := newDecoder()
+	raw := eventRecord()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.DecodeBtfBinary(ctx, eventType, raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPlanDecode(b *testing.B) {
+	plan, err := newDecoder().CompilePlan(eventType)
+	if err != nil {
+		b.Fatal(err)
+	}
+	raw := eventRecord()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		record, err := plan.Decode(raw)
+		if err != nil {
+			b.Fatal(err)
+		}
+		plan.Release(record)
+	}
+}
+
+func TestPlanUnit(t *testing.T) {
+	plan, err := newDecoder().CompilePlan(&btf.Struct{
+		Name: "write_t",
+		Size: 24,
+		Members: []btf.Member{
+			{Name: "latency", Type: durationType, Offset: 0},
+			{Name: "size", Type: &btf.Typedef{Name: byteCountTypeName, Type: u64Type}, Offset: 64},
+			{Name: "count", Type: u64Type, Offset: 128},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"latency": UnitNanoseconds,
+		"size":    UnitBytes,
+		"count":   "",
+		"missing": "",
+	} {
+		if unit := plan.Unit(key); unit != expected {
+			t.Errorf("expected unit of %s to be %q, found %q", key, expected, unit)
+		}
+	}
+}
+
+func TestPlanKind(t *testing.T) {
+	plan, err := newDecoder().CompilePlan(eventType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]Kind{
+		"daddr":   KindString,
+		"pid":     KindUint,
+		"ret":     KindInt,
+		"latency": KindDuration,
+		"bytes":   KindUint,
+		"comm":    KindString,
+		"missing": KindUnknown,
+	} {
+		if kind := plan.Kind(key); kind != expected {
+			t.Errorf("expected kind of %s to be %d, found %d", key, expected, kind)
+		}
+	}
+}
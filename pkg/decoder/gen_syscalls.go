@@ -0,0 +1,92 @@
+//go:build ignore
+// +build ignore
+
+// gen_syscalls writes the table of syscall names of an architecture, from
+// the SYS_ constants of golang.org/x/sys/unix at the version in go.mod.
+// Bump golang.org/x/sys to pick up the syscalls of newer kernels, then run
+//
+//	go generate ./pkg/decoder
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type syscall struct {
+	nr   uint64
+	name string
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: go run gen_syscalls.go <arch>")
+	}
+	arch := os.Args[1]
+
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "golang.org/x/sys").Output()
+	if err != nil {
+		log.Fatalf("could not find golang.org/x/sys: %v", err)
+	}
+	source := fmt.Sprintf("zsysnum_linux_%s.go", arch)
+	path := filepath.Join(strings.TrimSpace(string(out)), "unix", source)
+
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		log.Fatalf("could not parse %s: %v", path, err)
+	}
+	var syscalls []syscall
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			for i, name := range value.Names {
+				if !strings.HasPrefix(name.Name, "SYS_") || i >= len(value.Values) {
+					continue
+				}
+				lit, ok := value.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.INT {
+					continue
+				}
+				nr, err := strconv.ParseUint(lit.Value, 0, 32)
+				if err != nil {
+					log.Fatalf("could not parse the number of %s: %v", name.Name, err)
+				}
+				syscalls = append(syscalls, syscall{nr: nr, name: strings.ToLower(strings.TrimPrefix(name.Name, "SYS_"))})
+			}
+		}
+	}
+	sort.SliceStable(syscalls, func(i, j int) bool { return syscalls[i].nr < syscalls[j].nr })
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_syscalls.go from golang.org/x/sys/unix/%s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(&buf, "package decoder\n\n")
+	fmt.Fprintf(&buf, "// syscallNames maps %s syscall numbers to their names.\n", arch)
+	fmt.Fprintf(&buf, "var syscallNames = map[uint32]string{\n")
+	for _, s := range syscalls {
+		fmt.Fprintf(&buf, "\t%d: %q,\n", s.nr, s.name)
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("could not format the syscall table: %v", err)
+	}
+	if err := os.WriteFile(fmt.Sprintf("syscalls_%s.go", arch), formatted, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,325 @@
+package decoder
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How long a resolved name is trusted before being looked up again.
+// Ids such as pids and ifindexes are reused by the kernel, so this is kept short.
+const hostCacheTTL = 10 * time.Second
+
+// Pid is a process id along with the comm of the process, if it could be resolved.
+type Pid struct {
+	Pid  uint32 `json:"pid"`
+	Comm string `json:"comm,omitempty"`
+}
+
+func (p Pid) String() string {
+	if p.Comm == "" {
+		return strconv.FormatUint(uint64(p.Pid), 10)
+	}
+	return fmt.Sprintf("%s(%d)", p.Comm, p.Pid)
+}
+
+// User is a uid along with the user name from /etc/passwd, if it could be resolved.
+type User struct {
+	Uid  uint32 `json:"uid"`
+	Name string `json:"name,omitempty"`
+}
+
+func (u User) String() string {
+	if u.Name == "" {
+		return strconv.FormatUint(uint64(u.Uid), 10)
+	}
+	return u.Name
+}
+
+// Group is a gid along with the group name from /etc/group, if it could be resolved.
+type Group struct {
+	Gid  uint32 `json:"gid"`
+	Name string `json:"name,omitempty"`
+}
+
+func (g Group) String() string {
+	if g.Name == "" {
+		return strconv.FormatUint(uint64(g.Gid), 10)
+	}
+	return g.Name
+}
+
+// Errno is an error number as returned by the kernel. Both positive and
+// negative (i.e. -ENOENT) values are accepted.
+type Errno int32
+
+func (e Errno) String() string {
+	abs := e
+	if abs < 0 {
+		abs = -abs
+	}
+	if name := unix.ErrnoName(syscall.Errno(abs)); name != "" {
+		return name
+	}
+	return strconv.FormatInt(int64(e), 10)
+}
+
+// MarshalText renders the errno by its name, e.g. in JSON
+func (e Errno) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+//go:generate go run gen_syscalls.go amd64
+//go:generate go run gen_syscalls.go arm64
+
+// Syscall is a syscall number for the architecture bee is running on.
+type Syscall uint32
+
+func (s Syscall) String() string {
+	if name, ok := syscallNames[uint32(s)]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(s), 10)
+}
+
+// MarshalText renders the syscall by its name, e.g. in JSON
+func (s Syscall) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Ifindex is a network interface index along with the interface name, if it could be resolved.
+type Ifindex struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name,omitempty"`
+}
+
+func (i Ifindex) String() string {
+	if i.Name == "" {
+		return strconv.FormatUint(uint64(i.Index), 10)
+	}
+	return i.Name
+}
+
+// Cgroup is a cgroup v2 id along with the path of the cgroup relative to the
+// cgroup2 mount, if it could be resolved.
+type Cgroup struct {
+	ID   uint64 `json:"id"`
+	Path string `json:"path,omitempty"`
+}
+
+func (c Cgroup) String() string {
+	if c.Path == "" {
+		return strconv.FormatUint(c.ID, 10)
+	}
+	return c.Path
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+// hostResolver resolves ids found in kernel data to names using the host's
+// /proc, /etc/passwd, /etc/group, netlink and cgroup2 filesystem.
+// All lookups are cached so that resolving is cheap on the hot path.
+type hostResolver struct {
+	procRoot   string
+	passwdPath string
+	groupPath  string
+	cgroupRoot string
+
+	mu sync.Mutex
+
+	comms  map[uint32]cachedName
+	ifaces map[uint32]cachedName
+
+	users        map[uint32]string
+	usersExpire  time.Time
+	groups       map[uint32]string
+	groupsExpire time.Time
+
+	cgroups       map[uint64]string
+	cgroupsExpire time.Time
+}
+
+var defaultHostResolver = newHostResolver()
+
+func newHostResolver() *hostResolver {
+	return &hostResolver{
+		procRoot:   "/proc",
+		passwdPath: "/etc/passwd",
+		groupPath:  "/etc/group",
+		cgroupRoot: "/sys/fs/cgroup",
+		comms:      map[uint32]cachedName{},
+		ifaces:     map[uint32]cachedName{},
+	}
+}
+
+func (h *hostResolver) pid(val interface{}) (Pid, error) {
+	pid, err := toUint64(val)
+	if err != nil {
+		return Pid{}, err
+	}
+	p := uint32(pid)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if cached, ok := h.comms[p]; ok && now.Before(cached.expires) {
+		return Pid{Pid: p, Comm: cached.name}, nil
+	}
+	// A process which has already exited is cached as unresolved as well,
+	// so we don't hit /proc for every event it left behind.
+	var comm string
+	if raw, err := os.ReadFile(filepath.Join(h.procRoot, strconv.FormatUint(pid, 10), "comm")); err == nil {
+		comm = strings.TrimSpace(string(raw))
+	}
+	h.comms[p] = cachedName{name: comm, expires: now.Add(hostCacheTTL)}
+	return Pid{Pid: p, Comm: comm}, nil
+}
+
+func (h *hostResolver) user(val interface{}) (User, error) {
+	uid, err := toUint64(val)
+	if err != nil {
+		return User{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.After(h.usersExpire) {
+		h.users = parseIdFile(h.passwdPath)
+		h.usersExpire = now.Add(hostCacheTTL)
+	}
+	return User{Uid: uint32(uid), Name: h.users[uint32(uid)]}, nil
+}
+
+func (h *hostResolver) group(val interface{}) (Group, error) {
+	gid, err := toUint64(val)
+	if err != nil {
+		return Group{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.After(h.groupsExpire) {
+		h.groups = parseIdFile(h.groupPath)
+		h.groupsExpire = now.Add(hostCacheTTL)
+	}
+	return Group{Gid: uint32(gid), Name: h.groups[uint32(gid)]}, nil
+}
+
+func (h *hostResolver) ifindex(val interface{}) (Ifindex, error) {
+	idx, err := toUint64(val)
+	if err != nil {
+		return Ifindex{}, err
+	}
+	i := uint32(idx)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if cached, ok := h.ifaces[i]; ok && now.Before(cached.expires) {
+		return Ifindex{Index: i, Name: cached.name}, nil
+	}
+	// net.InterfaceByIndex queries the kernel over netlink
+	var name string
+	if iface, err := net.InterfaceByIndex(int(i)); err == nil {
+		name = iface.Name
+	}
+	h.ifaces[i] = cachedName{name: name, expires: now.Add(hostCacheTTL)}
+	return Ifindex{Index: i, Name: name}, nil
+}
+
+func (h *hostResolver) cgroup(val interface{}) (Cgroup, error) {
+	id, err := toUint64(val)
+	if err != nil {
+		return Cgroup{}, err
+	}
+
+	h.mu.Lock()
+	path, ok := h.cgroups[id]
+	// cgroups are created all the time, so rescan on a miss once the
+	// previous scan is old enough
+	now := time.Now()
+	if ok || !now.After(h.cgroupsExpire) {
+		h.mu.Unlock()
+		return Cgroup{ID: id, Path: path}, nil
+	}
+	// Walking the hierarchy is slow, so it is done without holding the lock.
+	// Misses in the meantime don't start another scan, they stay unresolved.
+	h.cgroupsExpire = now.Add(hostCacheTTL)
+	h.mu.Unlock()
+
+	cgroups := scanCgroups(h.cgroupRoot)
+	h.mu.Lock()
+	h.cgroups = cgroups
+	h.mu.Unlock()
+	return Cgroup{ID: id, Path: cgroups[id]}, nil
+}
+
+// parseIdFile reads a file in the /etc/passwd or /etc/group format and
+// returns the names keyed by their numeric id, i.e. the third field.
+func parseIdFile(path string) map[uint32]string {
+	names := map[uint32]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return names
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := names[uint32(id)]; !ok {
+			names[uint32(id)] = fields[0]
+		}
+	}
+	return names
+}
+
+// scanCgroups walks the cgroup2 hierarchy and returns the path of each cgroup
+// keyed by its id. On cgroup2 the id of a cgroup is the inode number of its directory.
+func scanCgroups(root string) map[uint64]string {
+	paths := map[uint64]string{}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		paths[stat.Ino] = filepath.Clean("/" + rel)
+		return nil
+	})
+	return paths
+}
@@ -0,0 +1,96 @@
+package decoder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// hostFixture lays out a /proc, /etc/passwd, /etc/group and cgroup2 hierarchy
+// under a temp dir, and returns a resolver reading from them
+func hostFixture(t *testing.T) (*hostResolver, string) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("proc/1234/comm", "curl\n")
+	write("etc/passwd", "# users\nroot:x:0:0:root:/root:/bin/bash\nbee:x:1000:1000::/home/bee:/bin/sh\nbroken\n")
+	write("etc/group", "root:x:0:\nbees:x:1000:bee\n")
+	if err := os.MkdirAll(filepath.Join(root, "cgroup", "system.slice", "sshd.service"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHostResolver()
+	h.procRoot = filepath.Join(root, "proc")
+	h.passwdPath = filepath.Join(root, "etc", "passwd")
+	h.groupPath = filepath.Join(root, "etc", "group")
+	h.cgroupRoot = filepath.Join(root, "cgroup")
+	return h, root
+}
+
+func inode(t *testing.T, path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestHostResolver(t *testing.T) {
+	h, root := hostFixture(t)
+	sshd := inode(t, filepath.Join(root, "cgroup", "system.slice", "sshd.service"))
+
+	for _, tc := range []struct {
+		name     string
+		resolve  func() (fmt.Stringer, error)
+		expected string
+	}{
+		{"pid", func() (fmt.Stringer, error) { return h.pid(uint32(1234)) }, "curl(1234)"},
+		{"exited pid", func() (fmt.Stringer, error) { return h.pid(uint32(4321)) }, "4321"},
+		{"user", func() (fmt.Stringer, error) { return h.user(uint32(1000)) }, "bee"},
+		{"unknown user", func() (fmt.Stringer, error) { return h.user(uint32(1001)) }, "1001"},
+		{"group", func() (fmt.Stringer, error) { return h.group(uint32(1000)) }, "bees"},
+		{"root group", func() (fmt.Stringer, error) { return h.group(uint32(0)) }, "root"},
+		{"cgroup", func() (fmt.Stringer, error) { return h.cgroup(sshd) }, "/system.slice/sshd.service"},
+		{"unknown cgroup", func() (fmt.Stringer, error) { return h.cgroup(uint64(1)) }, "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, err := tc.resolve()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := resolved.String(); found != tc.expected {
+				t.Errorf("expected %s, found %s", tc.expected, found)
+			}
+		})
+	}
+}
+
+func TestHostResolverCgroupRescan(t *testing.T) {
+	h, root := hostFixture(t)
+	if _, err := h.cgroup(uint64(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// created after the first scan, it is found once the scan is old enough
+	created := filepath.Join(root, "cgroup", "kubepods.slice")
+	if err := os.Mkdir(created, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	id := inode(t, created)
+	if c, _ := h.cgroup(id); c.Path != "" {
+		t.Errorf("expected no rescan before the previous scan expired, found %s", c.Path)
+	}
+	h.cgroupsExpire = h.cgroupsExpire.Add(-2 * hostCacheTTL)
+	if c, _ := h.cgroup(id); c.Path != "/kubepods.slice" {
+		t.Errorf("expected /kubepods.slice, found '%s'", c.Path)
+	}
+}
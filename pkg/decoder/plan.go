@@ -0,0 +1,171 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrShortRecord is returned when raw data is shorter than the type it is decoded as,
+// e.g. a ring buffer record which doesn't match the struct declared for the map.
+var ErrShortRecord = errors.New("record is shorter than its type")
+
+// Plan decodes raw binary data of a single btf type. The offset, size and
+// conversion of every field are resolved once when the plan is compiled, so
+// decoding a record is a straight pass over the fields.
+// Only the record map is pooled, see Release. Decoding still allocates for
+// the values: most integers are boxed into an interface{}, and strings and
+// addresses are built for every record.
+// A Plan is safe for concurrent use.
+type Plan struct {
+	// Size in bytes of the type the plan was compiled for
+	size   uint32
+	fields []fieldPlan
+
+	// Records handed back through Release, to be reused by Decode
+	records sync.Pool
+}
+
+// Kind is the type of the values a field is decoded to, as told by its btf type
+type Kind int
+
+const (
+	// The type isn't known up front, e.g. for typedefs with a registered decoder
+	KindUnknown Kind = iota
+	// Signed integers, decoded to int8 up to int64
+	KindInt
+	// Unsigned integers, decoded to uint8 up to uint64
+	KindUint
+	KindFloat
+	KindBool
+	// Strings, and values which are rendered as text, such as addresses, pids or errnos
+	KindString
+	// Arrays of unsigned chars, decoded to []byte
+	KindBytes
+	// duration fields, decoded to time.Duration
+	KindDuration
+	// ktime and boottime fields, decoded to time.Time
+	KindTime
+)
+
+type fieldPlan struct {
+	// Key of the field in decoded records, "" for non-struct types
+	name   string
+	offset uint32
+	size   uint32
+	decode decodeFunc
+	// Name of the typedef of the field, if any, e.g. duration
+	typedef string
+	kind    Kind
+
+	// Set for a flexible array member, which is decoded from the rest of the record
+	flexible bool
+	// Set for an array with a length member, which limits how much of the array is decoded
+	length *lengthPlan
+}
+
+// lengthPlan locates the integer member holding the length of an array member
+type lengthPlan struct {
+	offset uint32
+	size   uint32
+}
+
+func (l *lengthPlan) read(raw []byte) uint64 {
+	b := raw[l.offset : l.offset+l.size]
+	switch l.size {
+	case 8:
+		return Endianess.Uint64(b)
+	case 4:
+		return uint64(Endianess.Uint32(b))
+	case 2:
+		return uint64(Endianess.Uint16(b))
+	default:
+		return uint64(b[0])
+	}
+}
+
+// decodeFunc decodes a single value from raw, which starts at the value's offset
+type decodeFunc func(raw []byte) (interface{}, error)
+
+// Decode translates raw into a record in the same format as DecodeBtfBinary.
+// The record may be reused from a previous call, see Release.
+func (p *Plan) Decode(raw []byte) (map[string]interface{}, error) {
+	record, ok := p.records.Get().(map[string]interface{})
+	if !ok {
+		record = make(map[string]interface{}, len(p.fields))
+	}
+	if err := p.decodeInto(record, raw); err != nil {
+		p.records.Put(record)
+		return nil, err
+	}
+	return record, nil
+}
+
+// Release hands a record returned by Decode back to the plan for reuse.
+// The record must not be used after it has been released.
+func (p *Plan) Release(record map[string]interface{}) {
+	p.records.Put(record)
+}
+
+// Size returns the size in bytes of the type the plan was compiled for.
+func (p *Plan) Size() uint32 {
+	return p.size
+}
+
+// Unit returns the unit of the raw values of the field with the given key in
+// decoded records, UnitNanoseconds or UnitBytes, or "" if its type doesn't tell.
+func (p *Plan) Unit(key string) string {
+	for _, field := range p.fields {
+		if field.name != key {
+			continue
+		}
+		switch field.typedef {
+		case durationTypeName:
+			return UnitNanoseconds
+		case byteCountTypeName:
+			return UnitBytes
+		}
+	}
+	return ""
+}
+
+// Kind returns the kind of values the field with the given key in decoded
+// records is decoded to, or KindUnknown if there is no such field.
+func (p *Plan) Kind(key string) Kind {
+	for _, field := range p.fields {
+		if field.name == key {
+			return field.kind
+		}
+	}
+	return KindUnknown
+}
+
+func (p *Plan) decodeInto(record map[string]interface{}, raw []byte) error {
+	// Fields are checked to fit within size when compiling, so this is the
+	// only bounds check needed
+	if len(raw) < int(p.size) {
+		return fmt.Errorf("%w: found %d bytes, expected %d", ErrShortRecord, len(raw), p.size)
+	}
+	// Every field is written on each decode, so a reused record never
+	// carries values over from the previous one.
+	for i := range p.fields {
+		f := &p.fields[i]
+		end := f.offset + f.size
+		if f.flexible {
+			end = uint32(len(raw))
+		}
+		// The length member can't extend a field beyond the record or the
+		// array, only shorten it
+		if f.length != nil {
+			if n := f.length.read(raw); n < uint64(end-f.offset) {
+				end = f.offset + uint32(n)
+			}
+		}
+		val, err := f.decode(raw[f.offset:end])
+		if err != nil {
+			return err
+		}
+		record[f.name] = val
+	}
+	return nil
+}
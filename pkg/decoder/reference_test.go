@@ -0,0 +1,124 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// referenceDecoder is the decoder as it was before plans: it walks the btf
+// type for every record and reads every field through bytes.Buffer and
+// binary.Read. It only covers the types of eventType, and is kept to
+// benchmark the plans against.
+type referenceDecoder struct {
+	offset uint32
+	raw    []byte
+}
+
+func (d *referenceDecoder) decode(typ *btf.Struct, raw []byte) (map[string]interface{}, error) {
+	d.raw = raw
+	d.offset = 0
+	result := make(map[string]interface{})
+	for _, member := range typ.Members {
+		val, err := d.decodeType(member.Type)
+		if err != nil {
+			return nil, err
+		}
+		result[member.Name] = val
+	}
+	return result, nil
+}
+
+func (d *referenceDecoder) decodeType(typ btf.Type) (interface{}, error) {
+	switch typed := typ.(type) {
+	case *btf.Int:
+		buf := bytes.NewBuffer(d.raw[d.offset : d.offset+typed.Size])
+		d.offset += typed.Size
+		var val interface{}
+		switch {
+		case typed.Encoding == btf.Signed && typed.Size == 4:
+			val = new(int32)
+		case typed.Size == 4:
+			val = new(uint32)
+		case typed.Size == 8:
+			val = new(uint64)
+		default:
+			return nil, fmt.Errorf("unsupported int of %d bytes", typed.Size)
+		}
+		if err := binary.Read(buf, Endianess, val); err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(val).Elem().Interface(), nil
+	case *btf.Typedef:
+		underlying, err := getUnderlyingType(typed)
+		if err != nil {
+			return nil, err
+		}
+		val, err := d.decodeType(underlying)
+		if err != nil {
+			return nil, err
+		}
+		switch typed.Name {
+		case durationTypeName:
+			return u64ToDuration(val)
+		case ipv4AddrTypeName:
+			return u32ToIp(val)
+		}
+		return val, nil
+	case *btf.Array:
+		slice := make([]byte, typed.Nelems)
+		for i := range slice {
+			buf := bytes.NewBuffer(d.raw[d.offset : d.offset+1])
+			d.offset++
+			if err := binary.Read(buf, Endianess, &slice[i]); err != nil {
+				return nil, err
+			}
+		}
+		if n := bytes.IndexByte(slice, 0); n >= 0 {
+			slice = slice[:n]
+		}
+		return string(slice), nil
+	}
+	return nil, errors.New("unsupported type")
+}
+
+func TestReferenceDecoder(t *testing.T) {
+	plan, err := newDecoder().CompilePlan(eventType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := plan.Decode(eventRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := (&referenceDecoder{}).decode(eventType, eventRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the benchmarks only compare if both decode the same
+	if !reflect.DeepEqual(expected, found) {
+		t.Fatalf("expected %v, found %v", expected, found)
+	}
+}
+
+// BenchmarkReferenceDecode is the baseline for BenchmarkDecodeBtfBinary and
+// BenchmarkPlanDecode, all three run with
+//
+//	go test ./pkg/decoder -run '^$' -bench Decode
+func BenchmarkReferenceDecode(b *testing.B) {
+	d := &referenceDecoder{}
+	raw := eventRecord()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.decode(eventType, raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package decoder
+
+import "sync"
+
+// TypedefDecoder decodes the raw bytes of a field whose type is a custom typedef.
+// raw is sized as the typedef's underlying type, and must not be retained
+// after the decoder returns.
+type TypedefDecoder func(raw []byte) (interface{}, error)
+
+var (
+	typedefDecodersMutex sync.RWMutex
+	typedefDecoders      = map[string]TypedefDecoder{}
+)
+
+// RegisterTypedef registers a decoder for fields whose type is the typedef with
+// the given name, for both ring buffer records and hash map keys and values.
+// Registered decoders take precedence over the built-in typedefs, and
+// registering a name again replaces its decoder.
+// Decoders are looked up when a program is parsed, so they must be registered
+// before then, e.g. from an init function.
+func RegisterTypedef(name string, decode TypedefDecoder) {
+	typedefDecodersMutex.Lock()
+	defer typedefDecodersMutex.Unlock()
+	typedefDecoders[name] = decode
+}
+
+func lookupTypedef(name string) (TypedefDecoder, bool) {
+	typedefDecodersMutex.RLock()
+	defer typedefDecodersMutex.RUnlock()
+	decode, ok := typedefDecoders[name]
+	return decode, ok
+}
+
+// unregisterTypedef removes the decoder of a typedef, e.g. one registered by a test
+func unregisterTypedef(name string) {
+	typedefDecodersMutex.Lock()
+	defer typedefDecodersMutex.Unlock()
+	delete(typedefDecoders, name)
+}
@@ -0,0 +1,8 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package decoder
+
+// syscallNames is empty on architectures without a generated table, so
+// syscall numbers are rendered as-is.
+var syscallNames = map[uint32]string{}
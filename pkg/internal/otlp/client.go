@@ -0,0 +1,248 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/solo-io/bumblebee/pkg/internal/version"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+
+	// Name of the instrumentation scope all data is exported under
+	ScopeName = "github.com/solo-io/bumblebee"
+
+	metricsPath = "/v1/metrics"
+	logsPath    = "/v1/logs"
+)
+
+type Opts struct {
+	// Either ProtocolGRPC or ProtocolHTTP
+	Protocol string
+	// host:port for grpc, or the base URL (e.g. http://localhost:4318) for http/protobuf
+	Endpoint string
+	// Sent with every export, e.g. for authentication
+	Headers map[string]string
+	// Use plaintext instead of TLS for grpc. For http/protobuf this follows the endpoint's scheme.
+	Insecure bool
+	// Timeout of a single export
+	Timeout time.Duration
+}
+
+func (o *Opts) initDefaults() {
+	if o.Protocol == "" {
+		o.Protocol = ProtocolGRPC
+	}
+	if o.Endpoint == "" {
+		if o.Protocol == ProtocolHTTP {
+			o.Endpoint = "http://localhost:4318"
+		} else {
+			o.Endpoint = "localhost:4317"
+		}
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+}
+
+// Client exports OTLP data over either grpc or http/protobuf.
+type Client struct {
+	opts Opts
+
+	conn    *grpc.ClientConn
+	metrics colmetricspb.MetricsServiceClient
+	logs    collogspb.LogsServiceClient
+
+	httpClient *http.Client
+}
+
+func NewClient(ctx context.Context, opts *Opts) (*Client, error) {
+	opts.initDefaults()
+	c := &Client{opts: *opts}
+
+	switch opts.Protocol {
+	case ProtocolGRPC:
+		creds := credentials.NewTLS(&tls.Config{})
+		if opts.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		// Dialing doesn't block, a collector which is down is reported on export
+		conn, err := grpc.DialContext(ctx, opts.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("could not dial OTLP endpoint '%s': %w", opts.Endpoint, err)
+		}
+		c.conn = conn
+		c.metrics = colmetricspb.NewMetricsServiceClient(conn)
+		c.logs = collogspb.NewLogsServiceClient(conn)
+	case ProtocolHTTP:
+		c.httpClient = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol '%s', expected one of %s, %s", opts.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+	return c, nil
+}
+
+func (c *Client) ExportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	if c.conn != nil {
+		_, err := c.metrics.Export(c.outgoingContext(ctx), req)
+		return err
+	}
+	return c.post(ctx, metricsPath, req)
+}
+
+func (c *Client) ExportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	if c.conn != nil {
+		_, err := c.logs.Export(c.outgoingContext(ctx), req)
+		return err
+	}
+	return c.post(ctx, logsPath, req)
+}
+
+func (c *Client) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+func (c *Client) outgoingContext(ctx context.Context) context.Context {
+	for k, v := range c.opts.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+	}
+	return ctx
+}
+
+func (c *Client) post(ctx context.Context, path string, msg proto.Message) error {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(c.opts.Endpoint, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range c.opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+	}
+	return nil
+}
+
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("OTLP export to '%s' failed with status %s", e.url, e.status)
+}
+
+// Retryable tells whether an export which failed with err may succeed when
+// sent again, as defined by the OTLP specification for both protocols.
+// Connection errors are retryable as well.
+func Retryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.code {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+			codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// Resource builds the resource all data is exported under. host.name and
+// service.name are set unless overridden by attrs.
+func Resource(attrs map[string]string) *resourcepb.Resource {
+	all := map[string]string{
+		"service.name":    "bee",
+		"service.version": version.Version,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		all["host.name"] = hostname
+	}
+	for k, v := range attrs {
+		all[k] = v
+	}
+	return &resourcepb.Resource{
+		Attributes: Attributes(all),
+	}
+}
+
+// Scope is the instrumentation scope all data is exported under.
+func Scope() *commonpb.InstrumentationScope {
+	return &commonpb.InstrumentationScope{
+		Name:    ScopeName,
+		Version: version.Version,
+	}
+}
+
+// Attributes converts labels into OTLP attributes, sorted by key.
+func Attributes(labels map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, &commonpb.KeyValue{
+			Key: k,
+			Value: &commonpb.AnyValue{
+				Value: &commonpb.AnyValue_StringValue{StringValue: labels[k]},
+			},
+		})
+	}
+	return attrs
+}
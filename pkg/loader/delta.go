@@ -0,0 +1,78 @@
+package loader
+
+import (
+	"context"
+
+	"github.com/mitchellh/hashstructure/v2"
+	"github.com/solo-io/go-utils/contextutils"
+
+	"github.com/solo-io/bumblebee/pkg/stats"
+)
+
+// pollTracker is an instrument of a hash map which keeps state per entry. It
+// is told when a poll is done, so that it can forget the entries which were
+// deleted from the map.
+type pollTracker interface {
+	pollDone()
+}
+
+// deltaObserver turns the running totals of a hash map into the growth of
+// each entry since the previous poll before passing them on.
+type deltaObserver struct {
+	instrument stats.SetInstrument
+	// Last value seen per label set. Hash maps are polled from a single
+	// goroutine, so this doesn't need a lock.
+	last map[uint64]deltaEntry
+	// The poll being observed
+	poll uint64
+}
+
+type deltaEntry struct {
+	value int64
+	// The last poll the entry was seen in
+	poll uint64
+}
+
+func newDeltaObserver(instrument stats.SetInstrument) *deltaObserver {
+	return &deltaObserver{
+		instrument: instrument,
+		last:       map[uint64]deltaEntry{},
+	}
+}
+
+func (d *deltaObserver) Set(
+	ctx context.Context,
+	intVal int64,
+	labels map[string]string,
+) {
+	keyHash, err := hashstructure.Hash(labels, hashstructure.FormatV2, nil)
+	if err != nil {
+		// Labels are plain strings, this should never happen
+		contextutils.LoggerFrom(ctx).Errorf("could not hash labels %v: %s", labels, err)
+		return
+	}
+
+	last, seen := d.last[keyHash]
+	d.last[keyHash] = deltaEntry{value: intVal, poll: d.poll}
+	delta := intVal - last.value
+	if seen && delta == 0 {
+		// Nothing happened to this entry since the last poll
+		return
+	}
+	if delta < 0 {
+		// The entry was deleted and recreated, or reset, so everything in it is new
+		delta = intVal
+	}
+	d.instrument.Set(ctx, delta, labels)
+}
+
+// pollDone forgets the entries which weren't in the poll, as they were deleted
+// from the map. If they come back, everything in them is new.
+func (d *deltaObserver) pollDone() {
+	for keyHash, entry := range d.last {
+		if entry.poll != d.poll {
+			delete(d.last, keyHash)
+		}
+	}
+	d.poll++
+}
@@ -0,0 +1,58 @@
+package loader
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type recordingInstrument struct {
+	values []int64
+}
+
+func (r *recordingInstrument) Set(ctx context.Context, val int64, labels map[string]string) {
+	r.values = append(r.values, val)
+}
+
+func TestDeltaObserver(t *testing.T) {
+	ctx := context.Background()
+	recorded := &recordingInstrument{}
+	observer := newDeltaObserver(recorded)
+
+	labels := map[string]string{"pid": "1234"}
+	for _, total := range []int64{10, 10, 25, 4} {
+		observer.Set(ctx, total, labels)
+	}
+	// a different entry is tracked on its own
+	observer.Set(ctx, 7, map[string]string{"pid": "5678"})
+
+	// unchanged entries aren't observed, and a reset entry observes its new total
+	expected := []int64{10, 15, 4, 7}
+	if !reflect.DeepEqual(recorded.values, expected) {
+		t.Fatalf("expected observations %v, found %v", expected, recorded.values)
+	}
+}
+
+func TestDeltaObserverForgetsDeletedEntries(t *testing.T) {
+	ctx := context.Background()
+	recorded := &recordingInstrument{}
+	observer := newDeltaObserver(recorded)
+
+	first, second := map[string]string{"pid": "1234"}, map[string]string{"pid": "5678"}
+	// the second entry is deleted from the map after the first poll, and recreated in the third
+	for _, poll := range [][]map[string]string{{first, second}, {first}, {first, second}} {
+		for _, labels := range poll {
+			observer.Set(ctx, 10, labels)
+		}
+		observer.pollDone()
+		if poll[len(poll)-1]["pid"] == "1234" && len(observer.last) != 1 {
+			t.Errorf("expected the deleted entry to be forgotten, found %d entries", len(observer.last))
+		}
+	}
+
+	// the recreated entry observes its whole total again
+	expected := []int64{10, 10, 10}
+	if !reflect.DeepEqual(recorded.values, expected) {
+		t.Fatalf("expected observations %v, found %v", expected, recorded.values)
+	}
+}
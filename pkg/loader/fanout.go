@@ -0,0 +1,178 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/solo-io/go-utils/contextutils"
+	"go.uber.org/zap"
+)
+
+// DropPolicy decides what happens to an event when the buffer of a sink is full
+type DropPolicy string
+
+const (
+	// DropNewest discards the event which doesn't fit in the buffer
+	DropNewest DropPolicy = "newest"
+	// DropOldest discards the oldest buffered event to make room
+	DropOldest DropPolicy = "oldest"
+	// DropNone waits for room in the buffer, stalling the readers of the maps
+	DropNone DropPolicy = "none"
+)
+
+const DefaultSinkBufferSize = 1024
+
+func ParseDropPolicy(policy string) (DropPolicy, error) {
+	switch p := DropPolicy(policy); p {
+	case DropNewest, DropOldest, DropNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown drop policy '%s', expected one of %s, %s or %s", policy, DropNewest, DropOldest, DropNone)
+}
+
+// Sink is a watcher fed by the fan-out watcher through its own buffer
+type Sink struct {
+	// Name of the sink, used when reporting dropped events
+	Name    string
+	Watcher EventWatcher
+	// Number of events buffered for the sink. Defaults to DefaultSinkBufferSize
+	BufferSize int
+	// Defaults to DropNewest
+	DropPolicy DropPolicy
+}
+
+// NewFanoutWatcher returns a watcher which passes every event to all sinks.
+// Each sink receives its events on its own goroutine, from its own buffer, so
+// that a slow sink only drops its own events rather than stalling the readers
+// of the maps, unless its policy is DropNone. Maps are declared to the sinks
+// right away, so they always know a map before receiving its events. Dropped
+// events are reported to the logger of ctx.
+func NewFanoutWatcher(ctx context.Context, sinks ...Sink) EventWatcher {
+	w := &fanoutWatcher{logger: contextutils.LoggerFrom(ctx)}
+	for _, sink := range sinks {
+		if sink.BufferSize <= 0 {
+			sink.BufferSize = DefaultSinkBufferSize
+		}
+		if sink.DropPolicy == "" {
+			sink.DropPolicy = DropNewest
+		}
+		s := &fanoutSink{
+			Sink:   sink,
+			logger: w.logger,
+			events: make(chan Event, sink.BufferSize),
+		}
+		w.sinks = append(w.sinks, s)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for event := range s.events {
+				s.Watcher.SendEvent(event)
+			}
+		}()
+	}
+	return w
+}
+
+type fanoutWatcher struct {
+	logger *zap.SugaredLogger
+	sinks  []*fanoutSink
+	wg     sync.WaitGroup
+
+	// Held for reading while sending, so that the buffers aren't closed underneath
+	mu     sync.RWMutex
+	closed bool
+}
+
+type fanoutSink struct {
+	Sink
+	logger  *zap.SugaredLogger
+	events  chan Event
+	dropped uint64
+}
+
+func (w *fanoutWatcher) NewRingBuf(name string, keys []string) {
+	for _, s := range w.sinks {
+		s.Watcher.NewRingBuf(name, keys)
+	}
+}
+
+func (w *fanoutWatcher) NewHashMap(name string, keys []string) {
+	for _, s := range w.sinks {
+		s.Watcher.NewHashMap(name, keys)
+	}
+}
+
+func (w *fanoutWatcher) SendEvent(event Event) {
+	// Fields is reused once this returns, the sinks get their own copy
+	fields := make(map[string]interface{}, len(event.Fields))
+	for k, v := range event.Fields {
+		fields[k] = v
+	}
+	event.Fields = fields
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+	for _, s := range w.sinks {
+		s.send(event)
+	}
+}
+
+func (s *fanoutSink) send(event Event) {
+	switch s.DropPolicy {
+	case DropNone:
+		s.events <- event
+		return
+	case DropOldest:
+		for {
+			select {
+			case s.events <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.events:
+				s.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case s.events <- event:
+		default:
+			s.drop()
+		}
+	}
+}
+
+func (s *fanoutSink) drop() {
+	if atomic.AddUint64(&s.dropped, 1) == 1 {
+		s.logger.Warnf("output %s can't keep up, dropping the %s events", s.Name, s.DropPolicy)
+	}
+}
+
+// Close waits for the sinks to receive their buffered events before closing them
+func (w *fanoutWatcher) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	for _, s := range w.sinks {
+		close(s.events)
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	for _, s := range w.sinks {
+		if dropped := atomic.LoadUint64(&s.dropped); dropped > 0 {
+			w.logger.Warnf("output %s dropped %d events as its buffer was full", s.Name, dropped)
+		}
+		s.Watcher.Close()
+	}
+}
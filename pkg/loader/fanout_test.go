@@ -0,0 +1,96 @@
+package loader
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type recordingWatcher struct {
+	// Closed to let SendEvent return, nil to never block
+	unblock chan struct{}
+	// Signaled when SendEvent is called
+	received chan struct{}
+
+	mu     sync.Mutex
+	maps   []string
+	values []interface{}
+	closed bool
+}
+
+func (r *recordingWatcher) NewRingBuf(name string, keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maps = append(r.maps, name)
+}
+func (r *recordingWatcher) NewHashMap(name string, keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maps = append(r.maps, name)
+}
+func (r *recordingWatcher) SendEvent(event Event) {
+	if r.unblock != nil {
+		select {
+		case r.received <- struct{}{}:
+		default:
+		}
+		<-r.unblock
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, event.Fields["seq"])
+}
+func (r *recordingWatcher) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+func TestFanoutWatcher(t *testing.T) {
+	fast := &recordingWatcher{}
+	newest := &recordingWatcher{unblock: make(chan struct{}), received: make(chan struct{}, 1)}
+	oldest := &recordingWatcher{unblock: make(chan struct{}), received: make(chan struct{}, 1)}
+	watcher := NewFanoutWatcher(
+		context.Background(),
+		Sink{Name: "fast", Watcher: fast, DropPolicy: DropNone},
+		Sink{Name: "newest", Watcher: newest, BufferSize: 2},
+		Sink{Name: "oldest", Watcher: oldest, BufferSize: 2, DropPolicy: DropOldest},
+	)
+	watcher.NewRingBuf("events", []string{"seq"})
+
+	// the slow sinks take one event, which then blocks them, and buffer two more
+	fields := map[string]interface{}{}
+	for seq := 0; seq < 10; seq++ {
+		fields["seq"] = seq
+		watcher.SendEvent(Event{Name: "events", Fields: fields})
+		if seq == 0 {
+			<-newest.received
+			<-oldest.received
+		}
+	}
+	close(newest.unblock)
+	close(oldest.unblock)
+	watcher.Close()
+
+	var all []interface{}
+	for seq := 0; seq < 10; seq++ {
+		all = append(all, seq)
+	}
+	expected := map[*recordingWatcher][]interface{}{
+		fast:   all,
+		newest: {0, 1, 2},
+		oldest: {0, 8, 9},
+	}
+	for sink, values := range expected {
+		if !reflect.DeepEqual(sink.maps, []string{"events"}) {
+			t.Errorf("expected the map to be declared, found %v", sink.maps)
+		}
+		if !reflect.DeepEqual(sink.values, values) {
+			t.Errorf("expected events %v, found %v", values, sink.values)
+		}
+		if !sink.closed {
+			t.Error("expected the sink to be closed")
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package loader
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/solo-io/bumblebee/pkg/decoder"
+	"github.com/solo-io/go-utils/contextutils"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.uber.org/zap"
+)
+
+const (
+	FileFormatJSON    = "jsonl"
+	FileFormatCSV     = "csv"
+	FileFormatParquet = "parquet"
+)
+
+// Format of the time appended to the name of rotated files
+const rotatedTimeFormat = "2006-01-02T15-04-05.000"
+
+type FileOpts struct {
+	// Path of the file events are written to. CSV and Parquet files have
+	// columns of their own for each map, so each map is written to a file of
+	// its own, named after the map, e.g. events.print_events.csv for events.csv
+	Path string
+	// FileFormatJSON, FileFormatCSV or FileFormatParquet. Defaults to the
+	// format matching the extension of Path, or FileFormatJSON
+	Format string
+	// Files are rotated once they grow to this many bytes, 0 to not rotate by size
+	MaxSize int64
+	// Files are rotated once they are this old, 0 to not rotate by age.
+	// Rotation happens when the next event is written.
+	MaxAge time.Duration
+	// Rotated JSON and CSV files are compressed with gzip. Parquet files
+	// compress their pages with gzip instead, so they stay readable as Parquet.
+	Compress bool
+	// The location of the program, e.g. its image
+	Program string
+	// The maps being watched, which give the columns of CSV and Parquet files
+	WatchedMaps map[string]WatchedMap
+	// The options of the maps being watched, which give the value key of hash maps
+	WatchedMapOptions map[string]WatchedMapOptions
+}
+
+// FileFormat returns the format matching the extension of path, or FileFormatJSON
+func FileFormat(path string) string {
+	switch filepath.Ext(path) {
+	case ".csv":
+		return FileFormatCSV
+	case ".parquet":
+		return FileFormatParquet
+	}
+	return FileFormatJSON
+}
+
+// NewFileWatcher returns a watcher which writes every ring buffer event, and
+// every hash map entry which changed since the last poll, to files which are
+// rotated by size and age. Rotated files are renamed after the time they
+// were rotated, e.g. events-2022-01-31T12-00-00.000.jsonl, and a file which
+// already exists is rotated first. Errors writing the files are logged to the
+// logger of ctx.
+func NewFileWatcher(ctx context.Context, opts *FileOpts) (EventWatcher, error) {
+	if opts.Format == "" {
+		opts.Format = FileFormat(opts.Path)
+	}
+	switch opts.Format {
+	case FileFormatJSON, FileFormatCSV, FileFormatParquet:
+	default:
+		return nil, fmt.Errorf("unsupported file format '%s', expected one of %s, %s or %s",
+			opts.Format, FileFormatJSON, FileFormatCSV, FileFormatParquet)
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create directory for '%s': %w", opts.Path, err)
+	}
+	return &fileWatcher{
+		logger:  contextutils.LoggerFrom(ctx),
+		opts:    *opts,
+		files:   map[string]*eventFile{},
+		kinds:   map[string]string{},
+		entries: entryTracker{},
+	}, nil
+}
+
+type fileWatcher struct {
+	logger *zap.SugaredLogger
+	opts   FileOpts
+
+	mu sync.Mutex
+	// Files by map, JSON files are shared by all maps
+	files   map[string]*eventFile
+	kinds   map[string]string
+	entries entryTracker
+	// Rotated files being compressed
+	compressing sync.WaitGroup
+}
+
+func (w *fileWatcher) NewRingBuf(name string, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.kinds[name] = jsonKindRingBuf
+	w.newFile(name, keys)
+}
+
+func (w *fileWatcher) NewHashMap(name string, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.kinds[name] = jsonKindHashMap
+	w.entries.track(name)
+	w.newFile(name, keys)
+}
+
+func (w *fileWatcher) newFile(name string, keys []string) {
+	if w.opts.Format == FileFormatJSON {
+		for _, file := range w.files {
+			w.files[name] = file
+			return
+		}
+		w.files[name] = &eventFile{
+			path: w.opts.Path,
+			newEncoder: func(out io.Writer) (eventEncoder, error) {
+				return &jsonEncoder{encoder: json.NewEncoder(out), program: w.opts.Program}, nil
+			},
+		}
+		return
+	}
+
+	ext := filepath.Ext(w.opts.Path)
+	columns := fileColumns(w.opts.WatchedMaps[name], w.opts.WatchedMapOptions[name], keys, w.kinds[name] == jsonKindHashMap)
+	file := &eventFile{
+		path: strings.TrimSuffix(w.opts.Path, ext) + "." + name + ext,
+	}
+	if w.opts.Format == FileFormatCSV {
+		file.newEncoder = func(out io.Writer) (eventEncoder, error) {
+			return newCSVEncoder(out, columns)
+		}
+	} else {
+		compression := parquet.CompressionCodec_SNAPPY
+		if w.opts.Compress {
+			compression = parquet.CompressionCodec_GZIP
+		}
+		file.newEncoder = func(out io.Writer) (eventEncoder, error) {
+			return newParquetEncoder(out, columns, compression)
+		}
+	}
+	w.files[name] = file
+}
+
+func (w *fileWatcher) SendEvent(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	file, ok := w.files[event.Name]
+	if !ok || !w.entries.changed(event) {
+		return
+	}
+	now := time.Now()
+	if err := w.rotateIfNeeded(file, now); err != nil {
+		w.logger.Errorf("could not rotate '%s': %v", file.path, err)
+	}
+	if file.encoder == nil {
+		if err := w.open(file, now); err != nil {
+			w.logger.Errorf("could not open '%s': %v", file.path, err)
+			return
+		}
+	}
+	if err := file.encoder.encode(now, w.kinds[event.Name], event); err != nil {
+		w.logger.Errorf("could not write event of map %s to '%s': %v", event.Name, file.path, err)
+	}
+}
+
+func (w *fileWatcher) rotateIfNeeded(file *eventFile, now time.Time) error {
+	if file.encoder == nil {
+		return nil
+	}
+	size := file.written.n + file.encoder.buffered()
+	if (w.opts.MaxSize > 0 && size >= w.opts.MaxSize) || (w.opts.MaxAge > 0 && now.Sub(file.opened) >= w.opts.MaxAge) {
+		if err := file.close(); err != nil {
+			return err
+		}
+		return w.rotate(file.path, now)
+	}
+	return nil
+}
+
+// open starts a new file, rotating the file left at its path, e.g. by a previous run
+func (w *fileWatcher) open(file *eventFile, now time.Time) error {
+	if info, err := os.Stat(file.path); err == nil {
+		if err := w.rotate(file.path, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(file.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	file.out = out
+	file.written = &countingWriter{w: out}
+	file.opened = now
+	file.encoder, err = file.newEncoder(file.written)
+	if err != nil {
+		out.Close()
+		file.encoder = nil
+		return err
+	}
+	return nil
+}
+
+// rotate renames the file at path after the time t, compressing it in the background if configured
+func (w *fileWatcher) rotate(path string, t time.Time) error {
+	rotated := rotatedPath(path, t)
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+	if w.opts.Compress && w.opts.Format != FileFormatParquet {
+		w.compressing.Add(1)
+		go func() {
+			defer w.compressing.Done()
+			if err := compressFile(rotated); err != nil {
+				w.logger.Errorf("could not compress '%s': %v", rotated, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// rotatedPath returns the name of the file at path once rotated at t, which
+// is numbered if a file was already rotated at the same time
+func rotatedPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	base := fmt.Sprintf("%s-%s", strings.TrimSuffix(path, ext), t.UTC().Format(rotatedTimeFormat))
+	rotated := base + ext
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return rotated
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Close finishes the files, e.g. writes the footer of Parquet files, and
+// waits for rotated files to be compressed
+func (w *fileWatcher) Close() {
+	w.mu.Lock()
+	closed := map[*eventFile]bool{}
+	for _, file := range w.files {
+		if closed[file] {
+			continue
+		}
+		closed[file] = true
+		if err := file.close(); err != nil {
+			w.logger.Errorf("could not close '%s': %v", file.path, err)
+		}
+	}
+	w.mu.Unlock()
+	w.compressing.Wait()
+}
+
+// compressFile replaces the file at path with a gzip compressed copy, path.gz
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// eventFile is the current file of one or more maps
+type eventFile struct {
+	path       string
+	newEncoder func(out io.Writer) (eventEncoder, error)
+
+	// Set while the file is open
+	out     *os.File
+	written *countingWriter
+	encoder eventEncoder
+	opened  time.Time
+}
+
+func (f *eventFile) close() error {
+	if f.encoder == nil {
+		return nil
+	}
+	err := f.encoder.close()
+	if closeErr := f.out.Close(); err == nil {
+		err = closeErr
+	}
+	f.out, f.written, f.encoder = nil, nil, nil
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// eventEncoder writes events in the format of a file
+type eventEncoder interface {
+	encode(now time.Time, kind string, event Event) error
+	// buffered returns how many bytes were encoded but not written to the file yet
+	buffered() int64
+	// close flushes what's buffered, e.g. along with the footer of the file
+	close() error
+}
+
+type jsonEncoder struct {
+	encoder *json.Encoder
+	program string
+}
+
+func (e *jsonEncoder) encode(now time.Time, kind string, event Event) error {
+	return e.encoder.Encode(newJSONEvent(now, e.program, kind, event))
+}
+func (e *jsonEncoder) buffered() int64 { return 0 }
+func (e *jsonEncoder) close() error    { return nil }
+
+// fileColumn is a column of CSV and Parquet files, the time of the event, a
+// field of the event, or the value of a hash map entry
+type fileColumn struct {
+	name string
+	kind decoder.Kind
+	// Only one of these is set
+	time  bool
+	field string
+	value bool
+}
+
+// fileColumns returns the columns of the file of a map, in the order of its labels
+func fileColumns(watchedMap WatchedMap, opts WatchedMapOptions, keys []string, hashMap bool) []fileColumn {
+	columns := []fileColumn{{name: "time", kind: decoder.KindTime, time: true}}
+	for _, key := range keys {
+		columns = append(columns, fileColumn{name: key, kind: watchedMap.FieldKind(key), field: key})
+	}
+	if hashMap {
+		columns = append(columns, fileColumn{name: "value", kind: watchedMap.ValueKind(opts), value: true})
+	}
+	return columns
+}
+
+func (c fileColumn) get(now time.Time, event Event) interface{} {
+	switch {
+	case c.time:
+		return now
+	case c.value:
+		return event.Value
+	}
+	return event.Fields[c.field]
+}
+
+type csvEncoder struct {
+	writer  *csv.Writer
+	columns []fileColumn
+	row     []string
+}
+
+func newCSVEncoder(out io.Writer, columns []fileColumn) (*csvEncoder, error) {
+	e := &csvEncoder{
+		writer:  csv.NewWriter(out),
+		columns: columns,
+		row:     make([]string, len(columns)),
+	}
+	for i, column := range columns {
+		e.row[i] = column.name
+	}
+	if err := e.writer.Write(e.row); err != nil {
+		return nil, err
+	}
+	e.writer.Flush()
+	return e, e.writer.Error()
+}
+
+func (e *csvEncoder) encode(now time.Time, kind string, event Event) error {
+	for i, column := range e.columns {
+		switch v := column.get(now, event).(type) {
+		case nil:
+			e.row[i] = ""
+		case time.Duration:
+			// Durations are nanoseconds, as in JSON
+			e.row[i] = fmt.Sprint(int64(v))
+		default:
+			e.row[i] = formatStructured(v)
+		}
+	}
+	if err := e.writer.Write(e.row); err != nil {
+		return err
+	}
+	// Flushed on every row, so that rotation sees the size of the file
+	e.writer.Flush()
+	return e.writer.Error()
+}
+func (e *csvEncoder) buffered() int64 { return 0 }
+func (e *csvEncoder) close() error    { return nil }
+
+type parquetEncoder struct {
+	writer  *writer.CSVWriter
+	columns []fileColumn
+}
+
+func newParquetEncoder(out io.Writer, columns []fileColumn, compression parquet.CompressionCodec) (*parquetEncoder, error) {
+	schema := make([]string, 0, len(columns))
+	for _, column := range columns {
+		schema = append(schema, fmt.Sprintf("name=%s, %s", column.name, parquetType(column.kind)))
+	}
+	w, err := writer.NewCSVWriterFromWriter(schema, out, 1)
+	if err != nil {
+		return nil, err
+	}
+	w.CompressionType = compression
+	return &parquetEncoder{writer: w, columns: columns}, nil
+}
+
+// parquetType returns the Parquet type of columns of the given kind
+func parquetType(kind decoder.Kind) string {
+	switch kind {
+	case decoder.KindInt, decoder.KindDuration:
+		return "type=INT64"
+	case decoder.KindUint:
+		return "type=INT64, convertedtype=UINT_64"
+	case decoder.KindFloat:
+		return "type=DOUBLE"
+	case decoder.KindBool:
+		return "type=BOOLEAN"
+	case decoder.KindBytes:
+		return "type=BYTE_ARRAY"
+	case decoder.KindTime:
+		return "type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=NANOS"
+	}
+	// Strings, and values of unknown types rendered as text
+	return "type=BYTE_ARRAY, convertedtype=UTF8"
+}
+
+func (e *parquetEncoder) encode(now time.Time, kind string, event Event) error {
+	row := make([]interface{}, len(e.columns))
+	for i, column := range e.columns {
+		row[i] = parquetValue(column.kind, column.get(now, event))
+	}
+	return e.writer.Write(row)
+}
+
+// parquetValue converts a decoded value into the Go type the writer expects for its column
+func parquetValue(kind decoder.Kind, v interface{}) interface{} {
+	switch kind {
+	case decoder.KindInt, decoder.KindUint, decoder.KindDuration:
+		// UINT_64 is stored in an INT64, so values above math.MaxInt64 wrap around
+		typed, _ := toInt64(v)
+		return typed
+	case decoder.KindFloat:
+		switch typed := v.(type) {
+		case float32:
+			return float64(typed)
+		case float64:
+			return typed
+		}
+		return float64(0)
+	case decoder.KindBool:
+		typed, _ := v.(bool)
+		return typed
+	case decoder.KindBytes:
+		typed, _ := v.([]byte)
+		return string(typed)
+	case decoder.KindTime:
+		if typed, ok := v.(time.Time); ok {
+			return typed.UnixNano()
+		}
+		return int64(0)
+	}
+	if v == nil {
+		return ""
+	}
+	return formatStructured(v)
+}
+
+func (e *parquetEncoder) buffered() int64 {
+	return e.writer.Size + e.writer.ObjsSize
+}
+
+func (e *parquetEncoder) close() error {
+	return e.writer.WriteStop()
+}
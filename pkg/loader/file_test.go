@@ -0,0 +1,266 @@
+package loader
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/solo-io/bumblebee/pkg/decoder"
+)
+
+func fileTestMaps(t *testing.T) map[string]WatchedMap {
+	u32 := &btf.Int{Name: "unsigned int", Size: 4}
+	u64 := &btf.Int{Name: "unsigned long long", Size: 8}
+	plan, err := decoder.NewDecoderFactory()().CompilePlan(&btf.Struct{
+		Name: "event_t",
+		Size: 24,
+		Members: []btf.Member{
+			{Name: "daddr", Type: &btf.Typedef{Name: "ipv4_addr", Type: u32}, Offset: 0},
+			{Name: "comm", Type: &btf.Array{Type: &btf.Int{Name: "char", Size: 1, Encoding: btf.Signed}, Nelems: 4}, Offset: 32},
+			{Name: "latency", Type: &btf.Typedef{Name: "duration", Type: u64}, Offset: 64},
+			{Name: "bytes", Type: u64, Offset: 128},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]WatchedMap{
+		"print_events": {
+			Name:      "print_events",
+			Labels:    []string{"daddr", "comm", "latency", "bytes"},
+			mapType:   ebpf.RingBuf,
+			valuePlan: plan,
+		},
+	}
+}
+
+func sendFileTestEvents(watcher EventWatcher, n int) {
+	watcher.NewRingBuf("print_events", []string{"daddr", "comm", "latency", "bytes"})
+	for i := 0; i < n; i++ {
+		watcher.SendEvent(Event{
+			Name: "print_events",
+			Fields: map[string]interface{}{
+				"daddr":   "10.0.0.1",
+				"comm":    "curl",
+				"latency": time.Duration(i) * time.Millisecond,
+				"bytes":   uint64(i),
+			},
+		})
+	}
+}
+
+func TestFileWatcherRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	// left by a previous run
+	if err := os.WriteFile(path, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewFileWatcher(context.Background(), &FileOpts{
+		Path:     path,
+		MaxSize:  1,
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every event goes to a file of its own, as each fills the file
+	sendFileTestEvents(watcher, 3)
+	watcher.Close()
+
+	rotated, err := filepath.Glob(filepath.Join(dir, "events-*.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 3 {
+		t.Fatalf("expected the previous file and 2 events to be rotated and compressed, found %v", rotated)
+	}
+	var lines int
+	for _, name := range rotated {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(gz)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += strings.Count(string(content), "\n")
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 lines in the rotated files, found %d", lines)
+	}
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(current), `"bytes":2`) {
+		t.Errorf("expected the last event in the current file, found %s", current)
+	}
+}
+
+func TestFileWatcherCSV(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := NewFileWatcher(context.Background(), &FileOpts{
+		Path:        filepath.Join(dir, "events.csv"),
+		WatchedMaps: fileTestMaps(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendFileTestEvents(watcher, 2)
+	watcher.Close()
+
+	f, err := os.Open(filepath.Join(dir, "events.print_events.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows, found %v", rows)
+	}
+	if expected := []string{"time", "daddr", "comm", "latency", "bytes"}; !reflect.DeepEqual(rows[0], expected) {
+		t.Errorf("expected header %v, found %v", expected, rows[0])
+	}
+	if expected := []string{"10.0.0.1", "curl", "1000000", "1"}; !reflect.DeepEqual(rows[2][1:], expected) {
+		t.Errorf("expected row %v, found %v", expected, rows[2][1:])
+	}
+}
+
+func TestFileWatcherParquet(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := NewFileWatcher(context.Background(), &FileOpts{
+		Path:        filepath.Join(dir, "events.parquet"),
+		WatchedMaps: fileTestMaps(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendFileTestEvents(watcher, 2)
+	watcher.Close()
+
+	content, err := os.ReadFile(filepath.Join(dir, "events.print_events.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, err := buffer.NewBufferFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetReader(pf, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	if rows := pr.GetNumRows(); rows != 2 {
+		t.Errorf("expected 2 rows, found %d", rows)
+	}
+
+	// the root is followed by the columns, which the reader renames to Go names
+	types := map[string]parquet.Type{}
+	for i, element := range pr.Footer.Schema[1:] {
+		types[pr.SchemaHandler.Infos[i+1].ExName] = element.GetType()
+	}
+	expected := map[string]parquet.Type{
+		"time":    parquet.Type_INT64,
+		"daddr":   parquet.Type_BYTE_ARRAY,
+		"comm":    parquet.Type_BYTE_ARRAY,
+		"latency": parquet.Type_INT64,
+		"bytes":   parquet.Type_INT64,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected columns %v, found %v", expected, types)
+	}
+}
+
+func TestFileWatcherHashMapEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	watcher, err := NewFileWatcher(context.Background(), &FileOpts{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.NewHashMap("sizes", []string{"pid"})
+	// pid 2 is deleted from the map after the first poll, and added back in the fourth
+	for poll, pids := range [][]uint32{{1, 2}, {1}, {1}, {1, 2}} {
+		for _, pid := range pids {
+			watcher.SendEvent(Event{
+				Name:   "sizes",
+				Fields: map[string]interface{}{"pid": pid},
+				Value:  uint64(5),
+				Poll:   uint64(poll + 1),
+			})
+		}
+		if poll == 2 {
+			if entries := len(watcher.(*fileWatcher).entries["sizes"].entries); entries != 1 {
+				t.Errorf("expected the deleted entry to be forgotten, found %d entries", entries)
+			}
+		}
+	}
+	watcher.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], `"pid":2`) {
+		t.Errorf("expected both entries, then pid 2 again once it came back, found\n%s", content)
+	}
+}
+
+func TestFileColumnsHashMapValue(t *testing.T) {
+	compile := func(typ btf.Type) *decoder.Plan {
+		plan, err := decoder.NewDecoderFactory()().CompilePlan(typ)
+		if err != nil {
+			t.Fatalf("could not compile plan: %v", err)
+		}
+		return plan
+	}
+	gauge := WatchedMap{
+		Name:      "gauge_balance",
+		mapType:   ebpf.Hash,
+		valuePlan: compile(&btf.Int{Name: "long long", Size: 8, Encoding: btf.Signed}),
+	}
+	// values of a histogram are the field under its value key
+	hist := WatchedMap{
+		Name:      "hist_events",
+		mapType:   ebpf.Hash,
+		valuePlan: fileTestMaps(t)["print_events"].valuePlan,
+	}
+	for _, tc := range []struct {
+		watchedMap WatchedMap
+		opts       WatchedMapOptions
+		expected   decoder.Kind
+	}{
+		{gauge, WatchedMapOptions{}, decoder.KindInt},
+		{hist, WatchedMapOptions{HistValueKey: "latency"}, decoder.KindDuration},
+		{hist, WatchedMapOptions{HistValueKey: "bytes"}, decoder.KindUint},
+	} {
+		columns := fileColumns(tc.watchedMap, tc.opts, nil, true)
+		if value := columns[len(columns)-1]; !value.value || value.kind != tc.expected {
+			t.Errorf("expected the value column of %s to be of kind %v, found %+v", tc.watchedMap.Name, tc.expected, value)
+		}
+	}
+}
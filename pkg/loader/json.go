@@ -0,0 +1,160 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/solo-io/go-utils/contextutils"
+	"go.uber.org/zap"
+)
+
+const (
+	jsonKindRingBuf = "ringbuf"
+	jsonKindHashMap = "hashmap"
+)
+
+// jsonEvent is a single line written by the JSON watcher
+type jsonEvent struct {
+	Time    time.Time              `json:"time"`
+	Program string                 `json:"program"`
+	Map     string                 `json:"map"`
+	Kind    string                 `json:"kind"`
+	Fields  map[string]interface{} `json:"fields"`
+	Value   interface{}            `json:"value,omitempty"`
+}
+
+func newJSONEvent(now time.Time, program, kind string, event Event) jsonEvent {
+	fields := make(map[string]interface{}, len(event.Fields))
+	for k, v := range event.Fields {
+		fields[k] = jsonValue(v)
+	}
+	return jsonEvent{
+		Time:    now.UTC(),
+		Program: program,
+		Map:     event.Name,
+		Kind:    kind,
+		Fields:  fields,
+		Value:   jsonValue(event.Value),
+	}
+}
+
+// NewJSONWatcher returns a watcher which writes one JSON object per line to
+// w, for every ring buffer event and every hash map entry which changed since
+// the last poll. Fields keep their types, e.g. durations are nanoseconds and
+// timestamps RFC3339. program is the location of the program, e.g. its image.
+// Errors are logged to the logger of ctx.
+func NewJSONWatcher(ctx context.Context, w io.Writer, program string) EventWatcher {
+	return &jsonWatcher{
+		logger:  contextutils.LoggerFrom(ctx),
+		program: program,
+		encoder: json.NewEncoder(w),
+		kinds:   map[string]string{},
+		entries: entryTracker{},
+	}
+}
+
+type jsonWatcher struct {
+	logger  *zap.SugaredLogger
+	program string
+
+	mu      sync.Mutex
+	encoder *json.Encoder
+	kinds   map[string]string
+	entries entryTracker
+}
+
+func (w *jsonWatcher) NewRingBuf(name string, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.kinds[name] = jsonKindRingBuf
+}
+
+func (w *jsonWatcher) NewHashMap(name string, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.kinds[name] = jsonKindHashMap
+	w.entries.track(name)
+}
+
+func (w *jsonWatcher) SendEvent(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.entries.changed(event) {
+		return
+	}
+	err := w.encoder.Encode(newJSONEvent(time.Now(), w.program, w.kinds[event.Name], event))
+	if err != nil {
+		w.logger.Errorf("could not write event of map %s: %v", event.Name, err)
+	}
+}
+
+func (w *jsonWatcher) Close() {}
+
+// entryTracker remembers the last value of each entry of the tracked hash
+// maps, by map and encoded key, so that only entries which changed are written
+type entryTracker map[string]*trackedMap
+
+type trackedMap struct {
+	// The poll the latest event is from
+	poll    uint64
+	entries map[string]trackedEntry
+}
+
+type trackedEntry struct {
+	value []byte
+	// The last poll the entry was seen in
+	poll uint64
+}
+
+func (t entryTracker) track(name string) {
+	t[name] = &trackedMap{entries: map[string]trackedEntry{}}
+}
+
+// changed tells whether the event is a new or changed entry of a tracked map,
+// events of other maps always count as changed
+func (t entryTracker) changed(event Event) bool {
+	m, ok := t[event.Name]
+	if !ok {
+		return true
+	}
+	if event.Poll != m.poll {
+		// A new poll started, entries missing from the previous one were
+		// deleted from the map, and are new if they come back
+		for key, entry := range m.entries {
+			if entry.poll != m.poll {
+				delete(m.entries, key)
+			}
+		}
+		m.poll = event.Poll
+	}
+	// Entries which can't be encoded count as changed, so that writing them
+	// reports the error
+	key, err := json.Marshal(event.Fields)
+	if err != nil {
+		return true
+	}
+	value, err := json.Marshal(event.Value)
+	if err != nil {
+		return true
+	}
+	previous, seen := m.entries[string(key)]
+	m.entries[string(key)] = trackedEntry{value: value, poll: event.Poll}
+	return !seen || !bytes.Equal(previous.value, value)
+}
+
+// jsonValue converts decoded values which JSON would otherwise render in a
+// way that doesn't match the rest of bee, e.g. bytes are hex, not base64
+func jsonValue(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case []byte:
+		return hex.EncodeToString(typed)
+	case time.Duration:
+		return int64(typed)
+	}
+	return v
+}
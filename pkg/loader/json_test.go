@@ -0,0 +1,89 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONWatcher(t *testing.T) {
+	var out bytes.Buffer
+	watcher := NewJSONWatcher(context.Background(), &out, "ghcr.io/solo-io/bumblebee/tcpconnect:0.0.9")
+	watcher.NewRingBuf("events", []string{"saddr", "latency"})
+	watcher.NewHashMap("sizes", []string{"pid"})
+
+	watcher.SendEvent(Event{
+		Name:   "events",
+		Fields: map[string]interface{}{"saddr": "10.0.0.1", "latency": 3 * time.Millisecond},
+	})
+	// unchanged entries are only written once
+	for _, value := range []uint64{5, 5, 8} {
+		watcher.SendEvent(Event{
+			Name:   "sizes",
+			Fields: map[string]interface{}{"pid": uint32(1234)},
+			Value:  value,
+		})
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, found %d:\n%s", len(lines), out.String())
+	}
+	var events []jsonEvent
+	for _, line := range lines {
+		var event jsonEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("could not decode '%s': %v", line, err)
+		}
+		events = append(events, event)
+	}
+
+	if events[0].Kind != jsonKindRingBuf || events[0].Map != "events" {
+		t.Errorf("expected a ring buffer event of events, found %+v", events[0])
+	}
+	if events[0].Program != "ghcr.io/solo-io/bumblebee/tcpconnect:0.0.9" {
+		t.Errorf("expected the program ref, found '%s'", events[0].Program)
+	}
+	if latency := events[0].Fields["latency"]; latency != float64(3*time.Millisecond) {
+		t.Errorf("expected the latency in nanoseconds, found %v", latency)
+	}
+	if events[0].Value != nil {
+		t.Errorf("expected no value for a ring buffer event, found %v", events[0].Value)
+	}
+	for i, expected := range []float64{5, 8} {
+		event := events[i+1]
+		if event.Kind != jsonKindHashMap || event.Value != expected {
+			t.Errorf("expected hash map entry with value %v, found %+v", expected, event)
+		}
+	}
+}
+
+func TestEntryTrackerPrunes(t *testing.T) {
+	tracker := entryTracker{}
+	tracker.track("sizes")
+	send := func(poll uint64, pid uint32) bool {
+		return tracker.changed(Event{
+			Name:   "sizes",
+			Fields: map[string]interface{}{"pid": pid},
+			Value:  uint64(5),
+			Poll:   poll,
+		})
+	}
+
+	send(1, 1)
+	send(1, 2)
+	if send(2, 1) {
+		t.Errorf("expected an unchanged entry not to be written again")
+	}
+	// pid 2 was deleted from the map during poll 2, it is forgotten once poll 3 starts
+	send(3, 1)
+	if entries := len(tracker["sizes"].entries); entries != 1 {
+		t.Fatalf("expected 1 tracked entry, found %d", entries)
+	}
+	if !send(4, 2) {
+		t.Errorf("expected an entry which came back to be written again")
+	}
+}
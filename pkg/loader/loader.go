@@ -2,10 +2,10 @@ package loader
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -30,15 +30,33 @@ type ParsedELF struct {
 
 type LoadOptions struct {
 	ParsedELF *ParsedELF
-	Watcher   MapWatcher
-	PinMaps   string
-	PinProgs  string
+	// Receives the entries of the maps with their values rendered as strings.
+	// Ignored if EventWatcher is set
+	Watcher MapWatcher
+	// Receives the entries of the maps with their values as decoded
+	EventWatcher EventWatcher
+	PinMaps      string
+	PinProgs     string
+	// Reports when the maps are watched, and why loading stopped. Optional
+	Health *stats.Health
+}
+
+// eventWatcher returns the watcher the loader sends events to, adapting
+// Watcher if EventWatcher isn't set
+func (o *LoadOptions) eventWatcher() EventWatcher {
+	if o.EventWatcher != nil {
+		return o.EventWatcher
+	}
+	if o.Watcher != nil {
+		return NewStringWatcher(o.Watcher)
+	}
+	return NewNoopWatcher()
 }
 
 type Loader interface {
 	Parse(ctx context.Context, reader io.ReaderAt) (*ParsedELF, error)
 	Load(ctx context.Context, opts *LoadOptions) error
-	WatchMaps(ctx context.Context, watchedMaps map[string]WatchedMap, watchedMapOptions map[string]WatchedMapOptions, coll map[string]*ebpf.Map, watcher MapWatcher) error
+	WatchMaps(ctx context.Context, watchedMaps map[string]WatchedMap, watchedMapOptions map[string]WatchedMapOptions, coll map[string]*ebpf.Map, watcher EventWatcher) error
 }
 
 type WatchedMap struct {
@@ -49,16 +67,79 @@ type WatchedMap struct {
 	mapSpec *ebpf.MapSpec
 
 	valueStruct *btf.Struct
+
+	// Decode plans compiled at parse time. Ring buffers only have a value plan.
+	keyPlan   *decoder.Plan
+	valuePlan *decoder.Plan
+}
+
+// FieldKind returns the kind of values the field with the given label is
+// decoded to, from the records of a ring buffer, or the keys of a hash map
+func (w WatchedMap) FieldKind(label string) decoder.Kind {
+	plan := w.valuePlan
+	if w.mapType != ebpf.RingBuf {
+		plan = w.keyPlan
+	}
+	if plan == nil {
+		return decoder.KindUnknown
+	}
+	return plan.Kind(label)
+}
+
+// ValueKind returns the kind of the values of the entries of a hash map, which
+// are passed on to watchers as Event.Value
+func (w WatchedMap) ValueKind(opts WatchedMapOptions) decoder.Kind {
+	if w.mapType == ebpf.RingBuf || w.valuePlan == nil {
+		return decoder.KindUnknown
+	}
+	// Scalar values are decoded under the empty key
+	var valueKey string
+	if strings.HasPrefix(w.Name, histogramMapPrefix) {
+		valueKey = opts.HistValueKey
+	}
+	return w.valuePlan.Kind(valueKey)
 }
 
 type WatchedMapOptions struct {
 	HistValueKey string
 	HistBuckets  []float64
+	// What a hist_ hash map observes on each poll, HistObserveValue or HistObserveDelta
+	HistObserve string
+	// How a hist_ map is exported, HistTypeBuckets, HistTypeNative or HistTypeSummary
+	HistType string
+	// Growth factor of the buckets of a native histogram, defaults to 1.1
+	HistBucketFactor float64
+	// Quantiles exported by a summary, defaults to 0.5, 0.9 and 0.99
+	SummaryQuantiles []float64
+	// Field of the events of a counter_ ring buffer which is added to the
+	// counter, instead of counting events, or which a gauge_ ring buffer
+	// sets the gauge to
+	ValueKey string
 }
 
+const (
+	// Histogram with fixed buckets, the default
+	HistTypeBuckets = "buckets"
+	// Prometheus native histogram, or OTLP exponential histogram, whose
+	// buckets grow exponentially
+	HistTypeNative = "native"
+	// Summary exporting quantiles of the observed values
+	HistTypeSummary = "summary"
+)
+
+const (
+	// Observe the current value of each entry on every poll
+	HistObserveValue = "value"
+	// Observe how much each entry grew since the last poll
+	HistObserveDelta = "delta"
+)
+
 type loader struct {
 	decoderFactory  decoder.DecoderFactory
 	metricsProvider stats.MetricsProvider
+
+	// Counts records which could not be decoded, per map
+	malformedRecords stats.IncrementInstrument
 }
 
 func NewLoader(
@@ -66,8 +147,9 @@ func NewLoader(
 	metricsProvider stats.MetricsProvider,
 ) Loader {
 	return &loader{
-		decoderFactory:  decoderFactory,
-		metricsProvider: metricsProvider,
+		decoderFactory:   decoderFactory,
+		metricsProvider:  metricsProvider,
+		malformedRecords: metricsProvider.NewIncrementCounter(malformedRecordsMetricName, []string{"map"}, stats.UnitNone),
 	}
 }
 
@@ -76,8 +158,23 @@ const (
 	gaugeMapPrefix     = "gauge_"
 	histogramMapPrefix = "hist_"
 	printMapPrefix     = "print_"
+
+	malformedRecordsMetricName = stats.SelfMetricPrefix + "malformed_records"
+
+	displayTimeFormat = "2006-01-02 15:04:05.000000000"
 )
 
+var defaultHistBuckets = []float64{0, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// Default buckets of histograms of durations, in seconds, from 1µs to 10s
+var defaultLatencyBuckets = []float64{
+	0.000001, 0.0000025, 0.000005, 0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Default buckets of histograms of sizes, in bytes, from 64B to 64MiB
+var defaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864}
+
 func isPrintMap(spec *ebpf.MapSpec) bool {
 	return strings.HasPrefix(spec.Name, printMapPrefix)
 }
@@ -110,6 +207,7 @@ func (l *loader) Parse(ctx context.Context, progReader io.ReaderAt) (*ParsedELF,
 		}
 	}
 
+	d := l.decoderFactory()
 	watchedMaps := make(map[string]WatchedMap)
 	for name, mapSpec := range spec.Maps {
 		if !isTrackedMap(mapSpec) {
@@ -137,6 +235,10 @@ func (l *loader) Parse(ctx context.Context, progReader io.ReaderAt) (*ParsedELF,
 			labelKeys := getLabelsForBtfStruct(structType)
 
 			watchedMap.Labels = labelKeys
+			watchedMap.valuePlan, err = d.CompilePlan(structType)
+			if err != nil {
+				return nil, fmt.Errorf("could not compile decoder for map '%v' value: %w", name, err)
+			}
 		case ebpf.Hash:
 			labelKeys, err := getLabelsForHashMapKey(mapSpec)
 			if err != nil {
@@ -144,6 +246,14 @@ func (l *loader) Parse(ctx context.Context, progReader io.ReaderAt) (*ParsedELF,
 			}
 
 			watchedMap.Labels = labelKeys
+			watchedMap.keyPlan, err = d.CompilePlan(mapSpec.Key)
+			if err != nil {
+				return nil, fmt.Errorf("could not compile decoder for map '%v' key: %w", name, err)
+			}
+			watchedMap.valuePlan, err = d.CompilePlan(mapSpec.Value)
+			if err != nil {
+				return nil, fmt.Errorf("could not compile decoder for map '%v' value: %w", name, err)
+			}
 		default:
 			return nil, errors.New("unsupported map type")
 		}
@@ -158,11 +268,17 @@ func (l *loader) Parse(ctx context.Context, progReader io.ReaderAt) (*ParsedELF,
 	return &loadOptions, nil
 }
 
-func (l *loader) Load(ctx context.Context, opts *LoadOptions) error {
+func (l *loader) Load(ctx context.Context, opts *LoadOptions) (err error) {
 	// TODO: add invariant checks on opts
 	contextutils.LoggerFrom(ctx).Info("enter Load()")
+	watcher := opts.eventWatcher()
 	// on shutdown notify watcher we have no more entries to send
-	defer opts.Watcher.Close()
+	defer watcher.Close()
+	defer func() {
+		if err != nil {
+			opts.Health.SetFailed(err)
+		}
+	}()
 
 	// bail out before loading stuff into kernel if context canceled
 	if ctx.Err() != nil {
@@ -244,12 +360,13 @@ func (l *loader) Load(ctx context.Context, opts *LoadOptions) error {
 				if err := coll.Programs[name].Pin(pinFile); err != nil {
 					return fmt.Errorf("could not pin program '%s': %v", prog.Name, err)
 				}
-				fmt.Printf("Successfully pinned program '%v'\n", pinFile)
+				contextutils.LoggerFrom(ctx).Infof("Successfully pinned program '%v'", pinFile)
 			}
 		}
 	}
 
-	return l.WatchMaps(ctx, opts.ParsedELF.WatchedMaps, opts.ParsedELF.WatchedMapOptions, coll.Maps, opts.Watcher)
+	opts.Health.SetReady()
+	return l.WatchMaps(ctx, opts.ParsedELF.WatchedMaps, opts.ParsedELF.WatchedMapOptions, coll.Maps, watcher)
 }
 
 func (l *loader) WatchMaps(
@@ -257,7 +374,7 @@ func (l *loader) WatchMaps(
 	watchedMaps map[string]WatchedMap,
 	watchedMapOptions map[string]WatchedMapOptions,
 	maps map[string]*ebpf.Map,
-	watcher MapWatcher,
+	watcher EventWatcher,
 ) error {
 	contextutils.LoggerFrom(ctx).Info("enter watchMaps()")
 	eg, ctx := errgroup.WithContext(ctx)
@@ -267,40 +384,16 @@ func (l *loader) WatchMaps(
 
 		switch bpfMap.mapType {
 		case ebpf.RingBuf:
-			var increment stats.IncrementInstrument
-			var setIncrement stats.SetInstrument
-			var setKeyName string
-
-			if isCounterMap(bpfMap.mapSpec) {
-				increment = l.metricsProvider.NewIncrementCounter(name, bpfMap.Labels)
-			} else if isHistogramMap(bpfMap.mapSpec) {
-				setKeyName = "le"
-				buckets := []float64{0, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
-				if opts, ok := watchedMapOptions[name]; ok {
-					if opts.HistBuckets != nil {
-						buckets = opts.HistBuckets
-					}
-					if opts.HistValueKey != "" {
-						setKeyName = opts.HistValueKey
-					}
-				}
-				histLabels := []string{}
-				for _, label := range bpfMap.Labels {
-					if label != setKeyName {
-						histLabels = append(histLabels, label)
-					}
-				}
-
-				setIncrement = l.metricsProvider.NewHistogram(name, histLabels, buckets)
-			} else if isPrintMap(bpfMap.mapSpec) {
-				increment = &noop{}
+			increment, setIncrement, setKeyName, err := l.ringBufInstruments(name, bpfMap, watchedMapOptions[name])
+			if err != nil {
+				return err
 			}
 			eg.Go(func() error {
 				watcher.NewRingBuf(name, bpfMap.Labels)
 				if setIncrement != nil {
-					return l.startRingBufSet(ctx, bpfMap.valueStruct, maps[name], setIncrement, name, setKeyName, watcher)
+					return l.startRingBufSet(ctx, bpfMap.valuePlan, maps[name], setIncrement, name, setKeyName, watcher)
 				} else {
-					return l.startRingBufIncrement(ctx, bpfMap.valueStruct, maps[name], increment, name, watcher)
+					return l.startRingBufIncrement(ctx, bpfMap.valuePlan, maps[name], increment, name, watcher)
 				}
 			})
 		case ebpf.Array:
@@ -308,17 +401,45 @@ func (l *loader) WatchMaps(
 		case ebpf.Hash:
 			labelKeys := bpfMap.Labels
 			var instrument stats.SetInstrument
+			// Scalar values are decoded under the empty key
+			var valueKey string
 			if isCounterMap(bpfMap.mapSpec) {
-				instrument = l.metricsProvider.NewSetCounter(bpfMap.Name, labelKeys)
+				if err := checkValueKey(bpfMap.valuePlan, valueKey, name); err != nil {
+					return err
+				}
+				instrument = l.metricsProvider.NewSetCounter(bpfMap.Name, labelKeys, fieldUnit(bpfMap.valuePlan, valueKey))
 			} else if isGaugeMap(bpfMap.mapSpec) {
-				instrument = l.metricsProvider.NewGauge(bpfMap.Name, labelKeys)
-			} else {
-				instrument = &noop{}
+				if err := checkValueKey(bpfMap.valuePlan, valueKey, name); err != nil {
+					return err
+				}
+				instrument = l.metricsProvider.NewGauge(bpfMap.Name, labelKeys, fieldUnit(bpfMap.valuePlan, valueKey))
+			} else if isHistogramMap(bpfMap.mapSpec) {
+				opts := watchedMapOptions[name]
+				var buckets []float64
+				var unit stats.Unit
+				buckets, valueKey, unit = histogramOptions(opts, "", bpfMap.valuePlan)
+				if err := checkValueKey(bpfMap.valuePlan, valueKey, name); err != nil {
+					return err
+				}
+				var err error
+				instrument, err = l.newHistogram(bpfMap.Name, labelKeys, opts, buckets, unit)
+				if err != nil {
+					return err
+				}
+				switch opts.HistObserve {
+				case "", HistObserveValue:
+				case HistObserveDelta:
+					instrument = newDeltaObserver(instrument)
+				default:
+					return fmt.Errorf("unsupported histogram observation '%s' for map '%s', expected one of %s, %s",
+						opts.HistObserve, name, HistObserveValue, HistObserveDelta)
+				}
 			}
+			// print_ maps have no instrument, their entries are only passed on to the watcher
 			eg.Go(func() error {
 				// TODO: output type of instrument in UI?
 				watcher.NewHashMap(name, labelKeys)
-				return l.startHashMap(ctx, bpfMap.mapSpec, maps[name], instrument, name, watcher)
+				return l.startHashMap(ctx, bpfMap.keyPlan, bpfMap.valuePlan, maps[name], instrument, name, valueKey, watcher)
 			})
 		default:
 			// TODO: Support more map types
@@ -331,16 +452,59 @@ func (l *loader) WatchMaps(
 	return err
 }
 
+// ringBufInstruments creates the instrument of a ring buffer: events are
+// either counted by increment, or set on setIncrement using the field under
+// setKeyName
+func (l *loader) ringBufInstruments(
+	name string,
+	bpfMap WatchedMap,
+	opts WatchedMapOptions,
+) (increment stats.IncrementInstrument, setIncrement stats.SetInstrument, setKeyName string, err error) {
+	if isCounterMap(bpfMap.mapSpec) {
+		if valueKey := opts.ValueKey; valueKey != "" {
+			if err := checkValueKey(bpfMap.valuePlan, valueKey, name); err != nil {
+				return nil, nil, "", err
+			}
+			setKeyName = valueKey
+			unit := fieldUnit(bpfMap.valuePlan, valueKey)
+			counter := l.metricsProvider.NewIncrementCounter(name, labelsWithout(bpfMap.Labels, valueKey), unit)
+			setIncrement = &counterAdder{counter: counter}
+		} else {
+			increment = l.metricsProvider.NewIncrementCounter(name, bpfMap.Labels, stats.UnitNone)
+		}
+	} else if isGaugeMap(bpfMap.mapSpec) {
+		// Events can't be counted into a gauge, it needs a value to be set to
+		setKeyName = opts.ValueKey
+		if setKeyName == "" {
+			return nil, nil, "", fmt.Errorf("ring buffer gauge map '%s' needs a value key, e.g. --value-key=\"%s,<field>\"", name, name)
+		}
+		if err := checkValueKey(bpfMap.valuePlan, setKeyName, name); err != nil {
+			return nil, nil, "", err
+		}
+		unit := fieldUnit(bpfMap.valuePlan, setKeyName)
+		setIncrement = l.metricsProvider.NewGauge(name, labelsWithout(bpfMap.Labels, setKeyName), unit)
+	} else if isHistogramMap(bpfMap.mapSpec) {
+		var buckets []float64
+		var unit stats.Unit
+		buckets, setKeyName, unit = histogramOptions(opts, "le", bpfMap.valuePlan)
+		if err := checkValueKey(bpfMap.valuePlan, setKeyName, name); err != nil {
+			return nil, nil, "", err
+		}
+		setIncrement, err = l.newHistogram(name, labelsWithout(bpfMap.Labels, setKeyName), opts, buckets, unit)
+	} else if isPrintMap(bpfMap.mapSpec) {
+		increment = &noop{}
+	}
+	return increment, setIncrement, setKeyName, err
+}
+
 func (l *loader) startRingBufIncrement(
 	ctx context.Context,
-	valueStruct *btf.Struct,
+	valuePlan *decoder.Plan,
 	liveMap *ebpf.Map,
 	incrementInstrument stats.IncrementInstrument,
 	name string,
-	watcher MapWatcher,
+	watcher EventWatcher,
 ) error {
-	// Initialize decoder
-	d := l.decoderFactory()
 	logger := contextutils.LoggerFrom(ctx)
 
 	// Open a ringbuf reader from userspace RINGBUF map described in the
@@ -371,33 +535,43 @@ func (l *loader) startRingBufIncrement(
 			logger.Infof("error while reading from ringbuf '%s' reader: %s", name, err)
 			continue
 		}
-		result, err := d.DecodeBtfBinary(ctx, valueStruct, record.RawSample)
-		if err != nil {
-			return err
-		}
+		l.incrementRingBufRecord(ctx, valuePlan, record.RawSample, incrementInstrument, name, watcher)
+	}
+}
 
-		stringLabels := stringify(result)
-		incrementInstrument.Increment(ctx, stringLabels)
-		watcher.SendEntry(MapEntry{
-			Name: name,
-			Entry: KvPair{
-				Key: stringLabels,
-			},
-		})
+// incrementRingBufRecord counts a record of a ring buffer, labeled by its
+// fields, and passes it on to the watcher
+func (l *loader) incrementRingBufRecord(
+	ctx context.Context,
+	valuePlan *decoder.Plan,
+	raw []byte,
+	incrementInstrument stats.IncrementInstrument,
+	name string,
+	watcher EventWatcher,
+) {
+	result, err := valuePlan.Decode(raw)
+	if err != nil {
+		l.skipMalformed(ctx, name, err)
+		return
 	}
+
+	incrementInstrument.Increment(ctx, stringify(result))
+	watcher.SendEvent(Event{
+		Name:   name,
+		Fields: result,
+	})
+	valuePlan.Release(result)
 }
 
 func (l *loader) startRingBufSet(
 	ctx context.Context,
-	valueStruct *btf.Struct,
+	valuePlan *decoder.Plan,
 	liveMap *ebpf.Map,
 	instrument stats.SetInstrument,
 	name string,
 	valueKey string,
-	watcher MapWatcher,
+	watcher EventWatcher,
 ) error {
-	// Initialize decoder
-	d := l.decoderFactory()
 	logger := contextutils.LoggerFrom(ctx)
 
 	// Open a ringbuf reader from userspace RINGBUF map described in the
@@ -429,45 +603,65 @@ func (l *loader) startRingBufSet(
 			logger.Infof("error while reading from ringbuf '%s' reader: %s", name, err)
 			continue
 		}
-		result, err := d.DecodeBtfBinary(ctx, valueStruct, record.RawSample)
-		if err != nil {
+		if err := l.setRingBufRecord(ctx, valuePlan, record.RawSample, instrument, name, valueKey, watcher); err != nil {
 			return err
 		}
+	}
+}
 
-		intVal, ok := result[valueKey].(uint64)
-		if !ok {
-			return fmt.Errorf("value key '%s' is not a uint64", valueKey)
-		}
-
-		stringLabels := stringify(result)
-		watcher.SendEntry(MapEntry{
-			Name: name,
-			Entry: KvPair{
-				Key:   stringLabels,
-				Value: fmt.Sprint(intVal),
-			},
-		})
+// setRingBufRecord sets the instrument of a ring buffer to the field under
+// valueKey of a record, labeled by the other fields, and passes the record on
+// to the watcher
+func (l *loader) setRingBufRecord(
+	ctx context.Context,
+	valuePlan *decoder.Plan,
+	raw []byte,
+	instrument stats.SetInstrument,
+	name string,
+	valueKey string,
+	watcher EventWatcher,
+) error {
+	result, err := valuePlan.Decode(raw)
+	if err != nil {
+		l.skipMalformed(ctx, name, err)
+		return nil
+	}
 
-		delete(result, valueKey)
-		instrument.Set(ctx, int64(intVal), stringify(result))
+	value := result[valueKey]
+	intVal, ok := toInt64(value)
+	if !ok {
+		return fmt.Errorf("value key '%s' is not an integer, found %T", valueKey, value)
 	}
 
+	watcher.SendEvent(Event{
+		Name:   name,
+		Fields: result,
+		Value:  value,
+	})
+
+	delete(result, valueKey)
+	instrument.Set(ctx, intVal, stringify(result))
+	valuePlan.Release(result)
+	return nil
 }
 
 func (l *loader) startHashMap(
 	ctx context.Context,
-	mapSpec *ebpf.MapSpec,
+	keyPlan *decoder.Plan,
+	valuePlan *decoder.Plan,
 	liveMap *ebpf.Map,
 	instrument stats.SetInstrument,
 	name string,
-	watcher MapWatcher,
+	valueKey string,
+	watcher EventWatcher,
 ) error {
-	d := l.decoderFactory()
 
 	ticker := time.NewTicker(1 * time.Second)
+	var poll uint64
 	for {
 		select {
 		case <-ticker.C:
+			poll++
 			mapIter := liveMap.Iterate()
 			for {
 				// Use generic key,value so we can decode ourselves
@@ -480,31 +674,11 @@ func (l *loader) startHashMap(
 				if err := mapIter.Err(); err != nil {
 					return err
 				}
-				decodedKey, err := d.DecodeBtfBinary(ctx, mapSpec.Key, key)
-				if err != nil {
-					return fmt.Errorf("error decoding key: %w", err)
-				}
-
-				decodedValue, err := d.DecodeBtfBinary(ctx, mapSpec.Value, value)
-				if err != nil {
-					return fmt.Errorf("error decoding value: %w", err)
-				}
-
-				// TODO: Check this information at load time
-				if len(decodedValue) > 1 {
-					log.Fatal("only 1 value allowed")
-				}
-				intVal, ok := decodedValue[""].(uint64)
-				if !ok {
-					log.Fatal("only uint64 allowed")
-				}
-				stringLabels := stringify(decodedKey)
-				instrument.Set(ctx, int64(intVal), stringLabels)
-				thisKvPair := KvPair{Key: stringLabels, Value: fmt.Sprint(intVal)}
-				watcher.SendEntry(MapEntry{
-					Name:  name,
-					Entry: thisKvPair,
-				})
+				l.setHashMapEntry(ctx, keyPlan, valuePlan, key, value, instrument, name, valueKey, poll, watcher)
+			}
+			// An aborted iteration didn't see every entry, so none are forgotten
+			if tracker, ok := instrument.(pollTracker); ok && mapIter.Err() == nil {
+				tracker.pollDone()
 			}
 
 		case <-ctx.Done():
@@ -514,15 +688,211 @@ func (l *loader) startHashMap(
 	}
 }
 
+// setHashMapEntry sets the instrument of a hash map to the value of an entry,
+// labeled by its key, and passes the entry on to the watcher. Maps without an
+// instrument, i.e. print_ maps, pass on their values as decoded, whatever
+// their type.
+func (l *loader) setHashMapEntry(
+	ctx context.Context,
+	keyPlan *decoder.Plan,
+	valuePlan *decoder.Plan,
+	key, value []byte,
+	instrument stats.SetInstrument,
+	name string,
+	valueKey string,
+	poll uint64,
+	watcher EventWatcher,
+) {
+	decodedKey, err := keyPlan.Decode(key)
+	if err != nil {
+		l.skipMalformed(ctx, name, fmt.Errorf("error decoding key: %w", err))
+		return
+	}
+	defer keyPlan.Release(decodedKey)
+
+	decodedValue, err := valuePlan.Decode(value)
+	if err != nil {
+		l.skipMalformed(ctx, name, fmt.Errorf("error decoding value: %w", err))
+		return
+	}
+	rawVal, ok := decodedValue[valueKey]
+	if !ok {
+		// Struct values, which only print_ maps have without a value key,
+		// are passed on whole. The record is reused, so they are copied.
+		fields := make(map[string]interface{}, len(decodedValue))
+		for k, v := range decodedValue {
+			fields[k] = v
+		}
+		rawVal = fields
+	}
+	valuePlan.Release(decodedValue)
+
+	if instrument == nil {
+		watcher.SendEvent(Event{
+			Name:   name,
+			Fields: decodedKey,
+			Value:  rawVal,
+			Poll:   poll,
+		})
+		return
+	}
+	intVal, ok := toInt64(rawVal)
+	if !ok {
+		l.skipMalformed(ctx, name, fmt.Errorf("value of type %T is not an integer", rawVal))
+		return
+	}
+	instrument.Set(ctx, intVal, stringify(decodedKey))
+	watcher.SendEvent(Event{
+		Name:   name,
+		Fields: decodedKey,
+		Value:  rawVal,
+		Poll:   poll,
+	})
+}
+
+// newHistogram creates the instrument of a hist_ map, of the type set by opts
+func (l *loader) newHistogram(name string, labels []string, opts WatchedMapOptions, buckets []float64, unit stats.Unit) (stats.SetInstrument, error) {
+	switch opts.HistType {
+	case "", HistTypeBuckets:
+		return l.metricsProvider.NewHistogram(name, labels, buckets, unit), nil
+	case HistTypeNative:
+		// Buckets which were set explicitly are kept as classic buckets
+		return l.metricsProvider.NewNativeHistogram(name, labels, stats.NativeHistogramOpts{
+			BucketFactor:   opts.HistBucketFactor,
+			ClassicBuckets: opts.HistBuckets,
+		}, unit), nil
+	case HistTypeSummary:
+		return l.metricsProvider.NewSummary(name, labels, stats.SummaryOpts{
+			Quantiles: opts.SummaryQuantiles,
+		}, unit), nil
+	default:
+		return nil, fmt.Errorf("unsupported histogram type '%s' for map '%s', expected one of %s, %s, %s",
+			opts.HistType, name, HistTypeBuckets, HistTypeNative, HistTypeSummary)
+	}
+}
+
+// histogramOptions returns the buckets, value key and unit of a histogram map,
+// falling back to the defaults for any that weren't configured. The default
+// buckets suit the unit of the value.
+func histogramOptions(opts WatchedMapOptions, defaultValueKey string, valuePlan *decoder.Plan) ([]float64, string, stats.Unit) {
+	valueKey := defaultValueKey
+	if opts.HistValueKey != "" {
+		valueKey = opts.HistValueKey
+	}
+	unit := fieldUnit(valuePlan, valueKey)
+	buckets := defaultHistBuckets
+	switch {
+	case opts.HistBuckets != nil:
+		buckets = opts.HistBuckets
+	case unit == stats.UnitNanoseconds:
+		buckets = defaultLatencyBuckets
+	case unit == stats.UnitBytes:
+		buckets = defaultSizeBuckets
+	}
+	return buckets, valueKey, unit
+}
+
+// checkValueKey makes sure the values of a map can be set on an instrument,
+// i.e. that the field under valueKey of hash map values or ring buffer records
+// is an integer or a duration
+func checkValueKey(valuePlan *decoder.Plan, valueKey, name string) error {
+	switch valuePlan.Kind(valueKey) {
+	case decoder.KindInt, decoder.KindUint, decoder.KindDuration:
+		return nil
+	case decoder.KindUnknown:
+		if valueKey == "" {
+			// Struct values have no field under the empty key
+			return fmt.Errorf("values of map '%s' must be integers or durations, or a struct with --hist-value-key set to one of its fields", name)
+		}
+		return fmt.Errorf("value key '%s' is not a field of map '%s'", valueKey, name)
+	}
+	return fmt.Errorf("value key '%s' is not an integer or duration field of map '%s'", valueKey, name)
+}
+
+// fieldUnit returns the unit of the values of a field, from its type
+func fieldUnit(valuePlan *decoder.Plan, key string) stats.Unit {
+	if valuePlan == nil {
+		return stats.UnitNone
+	}
+	return stats.Unit(valuePlan.Unit(key))
+}
+
+// labelsWithout returns labels without the field which holds the value
+func labelsWithout(labels []string, valueKey string) []string {
+	without := []string{}
+	for _, label := range labels {
+		if label != valueKey {
+			without = append(without, label)
+		}
+	}
+	return without
+}
+
+// toInt64 converts a decoded integer field into the value of an instrument
+func toInt64(v interface{}) (int64, bool) {
+	switch typed := v.(type) {
+	case uint8:
+		return int64(typed), true
+	case uint16:
+		return int64(typed), true
+	case uint32:
+		return int64(typed), true
+	case uint64:
+		return int64(typed), true
+	case int8:
+		return int64(typed), true
+	case int16:
+		return int64(typed), true
+	case int32:
+		return int64(typed), true
+	case int64:
+		return typed, true
+	case time.Duration:
+		return int64(typed), true
+	}
+	return 0, false
+}
+
+// skipMalformed records a record of the given map which could not be decoded.
+// A single bad record shouldn't stop the map from being watched, so it is dropped.
+func (l *loader) skipMalformed(ctx context.Context, name string, err error) {
+	l.malformedRecords.Increment(ctx, map[string]string{"map": name})
+	contextutils.LoggerFrom(ctx).Infof("skipping malformed record from map '%s': %s", name, err)
+}
+
+// stringify renders decoded values for structured outputs such as metric labels
 func stringify(decodedBinary map[string]interface{}) map[string]string {
 	keyMap := map[string]string{}
 	for k, v := range decodedBinary {
-		valAsStr := fmt.Sprint(v)
-		keyMap[k] = valAsStr
+		keyMap[k] = formatStructured(v)
 	}
 	return keyMap
 }
 
+// formatStructured renders a decoded value for structured outputs,
+// i.e. with timestamps in RFC3339 format
+func formatStructured(v interface{}) string {
+	switch typed := v.(type) {
+	case time.Time:
+		return typed.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return hex.EncodeToString(typed)
+	}
+	return fmt.Sprint(v)
+}
+
+// formatForDisplay renders a decoded value for people reading it,
+// i.e. with timestamps in local time
+func formatForDisplay(v interface{}) string {
+	switch typed := v.(type) {
+	case time.Time:
+		return typed.Local().Format(displayTimeFormat)
+	case []byte:
+		return hex.EncodeToString(typed)
+	}
+	return fmt.Sprint(v)
+}
+
 func getLabelsForHashMapKey(mapSpec *ebpf.MapSpec) ([]string, error) {
 	structKey, ok := mapSpec.Key.(*btf.Struct)
 	if !ok {
@@ -540,6 +910,24 @@ func getLabelsForBtfStruct(structKey *btf.Struct) []string {
 	return keys
 }
 
+// counterAdder adds the value it is set to to a counter, for counters which
+// add up a field of each event
+type counterAdder struct {
+	counter stats.IncrementInstrument
+}
+
+func (a *counterAdder) Set(
+	ctx context.Context,
+	val int64,
+	labels map[string]string,
+) {
+	// Counters can't go down
+	if val < 0 {
+		return
+	}
+	a.counter.Add(ctx, val, labels)
+}
+
 type noop struct{}
 
 func (n *noop) Increment(
@@ -548,6 +936,13 @@ func (n *noop) Increment(
 ) {
 }
 
+func (n *noop) Add(
+	ctx context.Context,
+	val int64,
+	decodedKey map[string]string,
+) {
+}
+
 func (n *noop) Set(
 	ctx context.Context,
 	val int64,
@@ -0,0 +1,383 @@
+package loader
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+
+	"github.com/solo-io/bumblebee/pkg/decoder"
+	"github.com/solo-io/bumblebee/pkg/stats"
+)
+
+type addRecorder struct {
+	added []int64
+}
+
+func (a *addRecorder) Increment(ctx context.Context, labels map[string]string) {
+	a.added = append(a.added, 1)
+}
+
+func (a *addRecorder) Add(ctx context.Context, val int64, labels map[string]string) {
+	a.added = append(a.added, val)
+}
+
+func TestCounterAdder(t *testing.T) {
+	ctx := context.Background()
+	recorded := &addRecorder{}
+	adder := &counterAdder{counter: recorded}
+
+	for _, field := range []interface{}{uint32(1500), uint64(40), int32(-1), time.Microsecond} {
+		val, ok := toInt64(field)
+		if !ok {
+			t.Fatalf("expected %T to be an integer", field)
+		}
+		adder.Set(ctx, val, map[string]string{"daddr": "1.1.1.1"})
+	}
+	if _, ok := toInt64("1500"); ok {
+		t.Fatalf("expected strings not to be integers")
+	}
+
+	// negative values would make the counter go down
+	expected := []int64{1500, 40, 1000}
+	if !reflect.DeepEqual(recorded.added, expected) {
+		t.Fatalf("expected %v to be added, found %v", expected, recorded.added)
+	}
+}
+
+func TestLabelsWithout(t *testing.T) {
+	labels := labelsWithout([]string{"saddr", "bytes", "daddr"}, "bytes")
+	if !reflect.DeepEqual(labels, []string{"saddr", "daddr"}) {
+		t.Fatalf("expected the value key to be removed, found %v", labels)
+	}
+}
+
+func TestCheckValueKey(t *testing.T) {
+	u64 := &btf.Int{Name: "unsigned long long", Size: 8}
+	compile := func(typ btf.Type) *decoder.Plan {
+		plan, err := decoder.NewDecoderFactory()().CompilePlan(typ)
+		if err != nil {
+			t.Fatalf("could not compile plan: %v", err)
+		}
+		return plan
+	}
+
+	if err := checkValueKey(compile(u64), "", "counter"); err != nil {
+		t.Errorf("expected u64 values to be accepted, found %v", err)
+	}
+	if err := checkValueKey(compile(&btf.Typedef{Name: "duration", Type: u64}), "", "counter"); err != nil {
+		t.Errorf("expected duration values to be accepted, found %v", err)
+	}
+	if err := checkValueKey(compile(&btf.Typedef{Name: "ipv4_addr", Type: &btf.Int{Name: "unsigned int", Size: 4}}), "", "counter"); err == nil {
+		t.Errorf("expected addresses to be rejected")
+	}
+
+	value := compile(&btf.Struct{
+		Name: "value",
+		Size: 16,
+		Members: []btf.Member{
+			{Name: "count", Type: &btf.Int{Name: "int", Size: 4, Encoding: btf.Signed}, Offset: 0},
+			{Name: "comm", Type: &btf.Array{Type: &btf.Int{Name: "char", Size: 1, Encoding: btf.Signed}, Nelems: 4}, Offset: 32},
+			{Name: "latency", Type: &btf.Typedef{Name: "duration", Type: u64}, Offset: 64},
+		},
+	})
+	for _, key := range []string{"count", "latency"} {
+		if err := checkValueKey(value, key, "hist"); err != nil {
+			t.Errorf("expected value key %s to be accepted, found %v", key, err)
+		}
+	}
+	for _, key := range []string{"", "comm", "missing"} {
+		if err := checkValueKey(value, key, "hist"); err == nil {
+			t.Errorf("expected value key '%s' to be rejected", key)
+		}
+	}
+}
+
+func TestRingBufCounterValueKey(t *testing.T) {
+	l := NewLoader(decoder.NewDecoderFactory(), &fakeMetricsProvider{gauges: map[string]*fakeGauge{}}).(*loader)
+	bpfMap := fileTestMaps(t)["print_events"]
+	bpfMap.Name = "counter_events"
+	bpfMap.mapSpec = &ebpf.MapSpec{Name: "counter_events", Type: ebpf.RingBuf}
+
+	for _, key := range []string{"comm", "daddr", "missing"} {
+		if _, _, _, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{ValueKey: key}); err == nil {
+			t.Errorf("expected value key '%s' to be rejected", key)
+		}
+	}
+	for _, key := range []string{"bytes", "latency"} {
+		if _, set, _, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{ValueKey: key}); err != nil || set == nil {
+			t.Errorf("expected value key '%s' to be added to the counter, found %v", key, err)
+		}
+	}
+}
+
+func TestRingBufHistogramValueKey(t *testing.T) {
+	l := NewLoader(decoder.NewDecoderFactory(), &fakeMetricsProvider{gauges: map[string]*fakeGauge{}}).(*loader)
+	bpfMap := fileTestMaps(t)["print_events"]
+	bpfMap.Name = "hist_events"
+	bpfMap.mapSpec = &ebpf.MapSpec{Name: "hist_events", Type: ebpf.RingBuf}
+
+	// the default value key is le, which the struct doesn't have
+	for _, key := range []string{"", "comm", "missing"} {
+		if _, _, _, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{HistValueKey: key}); err == nil {
+			t.Errorf("expected value key '%s' to be rejected", key)
+		}
+	}
+	_, set, valueKey, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{HistValueKey: "latency"})
+	if err != nil || set == nil || valueKey != "latency" {
+		t.Errorf("expected latency to be observed, found value key '%s' and %v", valueKey, err)
+	}
+}
+
+// fakeMetricsProvider records the gauges it creates, every other instrument is a noop
+type fakeMetricsProvider struct {
+	gauges map[string]*fakeGauge
+}
+
+type fakeGauge struct {
+	labels []string
+	unit   stats.Unit
+	sets   []fakeSet
+}
+
+type fakeSet struct {
+	value  int64
+	labels map[string]string
+}
+
+func (g *fakeGauge) Set(ctx context.Context, val int64, labels map[string]string) {
+	g.sets = append(g.sets, fakeSet{value: val, labels: labels})
+}
+
+func (f *fakeMetricsProvider) NewSetCounter(name string, labels []string, unit stats.Unit) stats.SetInstrument {
+	return &noop{}
+}
+
+func (f *fakeMetricsProvider) NewIncrementCounter(name string, labels []string, unit stats.Unit) stats.IncrementInstrument {
+	return &noop{}
+}
+
+func (f *fakeMetricsProvider) NewGauge(name string, labels []string, unit stats.Unit) stats.SetInstrument {
+	g := &fakeGauge{labels: labels, unit: unit}
+	f.gauges[name] = g
+	return g
+}
+
+func (f *fakeMetricsProvider) NewHistogram(name string, labels []string, buckets []float64, unit stats.Unit) stats.SetInstrument {
+	return &noop{}
+}
+
+func (f *fakeMetricsProvider) NewNativeHistogram(name string, labels []string, opts stats.NativeHistogramOpts, unit stats.Unit) stats.SetInstrument {
+	return &noop{}
+}
+
+func (f *fakeMetricsProvider) NewSummary(name string, labels []string, opts stats.SummaryOpts, unit stats.Unit) stats.SetInstrument {
+	return &noop{}
+}
+
+// eventRecorder keeps a copy of every event, as Fields is reused
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) NewRingBuf(name string, keys []string) {}
+func (r *eventRecorder) NewHashMap(name string, keys []string) {}
+func (r *eventRecorder) SendEvent(event Event) {
+	fields := make(map[string]interface{}, len(event.Fields))
+	for k, v := range event.Fields {
+		fields[k] = v
+	}
+	event.Fields = fields
+	r.events = append(r.events, event)
+}
+func (r *eventRecorder) Close() {}
+
+// queueDepthMap is a ring buffer gauge of struct { u32 cpu; duration wait; }
+func queueDepthMap(t *testing.T) WatchedMap {
+	plan, err := decoder.NewDecoderFactory()().CompilePlan(&btf.Struct{
+		Name: "depth_t",
+		Size: 12,
+		Members: []btf.Member{
+			{Name: "cpu", Type: &btf.Int{Name: "unsigned int", Size: 4}, Offset: 0},
+			{Name: "wait", Type: &btf.Typedef{Name: "duration", Type: &btf.Int{Name: "unsigned long long", Size: 8}}, Offset: 32},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return WatchedMap{
+		Name:      "gauge_wait",
+		Labels:    []string{"cpu", "wait"},
+		mapType:   ebpf.RingBuf,
+		mapSpec:   &ebpf.MapSpec{Name: "gauge_wait", Type: ebpf.RingBuf},
+		valuePlan: plan,
+	}
+}
+
+func queueDepthRecord(cpu uint32, wait time.Duration) []byte {
+	raw := make([]byte, 12)
+	decoder.Endianess.PutUint32(raw[0:4], cpu)
+	decoder.Endianess.PutUint64(raw[4:12], uint64(wait))
+	return raw
+}
+
+func TestRingBufGauge(t *testing.T) {
+	ctx := context.Background()
+	provider := &fakeMetricsProvider{gauges: map[string]*fakeGauge{}}
+	l := NewLoader(decoder.NewDecoderFactory(), provider).(*loader)
+	bpfMap := queueDepthMap(t)
+
+	if _, _, _, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{}); err == nil {
+		t.Fatalf("expected a gauge without a value key to be rejected")
+	}
+	if _, _, _, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{ValueKey: "latency"}); err == nil {
+		t.Fatalf("expected a value key which isn't a field to be rejected")
+	}
+	events := fileTestMaps(t)["print_events"]
+	events.mapSpec = &ebpf.MapSpec{Name: "gauge_events", Type: ebpf.RingBuf}
+	if _, _, _, err := l.ringBufInstruments("gauge_events", events, WatchedMapOptions{ValueKey: "comm"}); err == nil {
+		t.Fatalf("expected a value key which isn't an integer to be rejected")
+	}
+	increment, set, valueKey, err := l.ringBufInstruments(bpfMap.Name, bpfMap, WatchedMapOptions{ValueKey: "wait"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if increment != nil || valueKey != "wait" {
+		t.Fatalf("expected the gauge to be set to wait, found increment %v and value key '%s'", increment, valueKey)
+	}
+	gauge := provider.gauges["gauge_wait"]
+	if gauge == nil || !reflect.DeepEqual(gauge.labels, []string{"cpu"}) || gauge.unit != stats.UnitNanoseconds {
+		t.Fatalf("expected a gauge in nanoseconds labeled by cpu, found %+v", gauge)
+	}
+
+	watcher := &eventRecorder{}
+	for _, wait := range []time.Duration{3 * time.Millisecond, time.Millisecond} {
+		if err := l.setRingBufRecord(ctx, bpfMap.valuePlan, queueDepthRecord(2, wait), set, bpfMap.Name, valueKey, watcher); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []fakeSet{
+		{value: int64(3 * time.Millisecond), labels: map[string]string{"cpu": "2"}},
+		{value: int64(time.Millisecond), labels: map[string]string{"cpu": "2"}},
+	}
+	if !reflect.DeepEqual(gauge.sets, expected) {
+		t.Errorf("expected the gauge to be set to %v, found %v", expected, gauge.sets)
+	}
+	if len(watcher.events) != 2 || watcher.events[1].Value != time.Millisecond {
+		t.Errorf("expected both events to reach the watcher with their wait, found %+v", watcher.events)
+	}
+}
+
+func TestEventsKeepDecodedTypes(t *testing.T) {
+	ctx := context.Background()
+	l := NewLoader(decoder.NewDecoderFactory(), &fakeMetricsProvider{gauges: map[string]*fakeGauge{}}).(*loader)
+	watcher := &eventRecorder{}
+
+	// print_events of fileTestMaps, struct { ipv4_addr daddr; char comm[4]; duration latency; u64 bytes; }
+	record := make([]byte, 24)
+	copy(record[0:4], []byte{10, 0, 0, 1})
+	copy(record[4:8], "curl")
+	decoder.Endianess.PutUint64(record[8:16], uint64(3*time.Millisecond))
+	decoder.Endianess.PutUint64(record[16:24], 4096)
+	ringBuf := fileTestMaps(t)["print_events"]
+	l.incrementRingBufRecord(ctx, ringBuf.valuePlan, record, &noop{}, "print_events", watcher)
+
+	// struct { ipv4_addr daddr; u32 pid; } -> duration
+	compile := func(typ btf.Type) *decoder.Plan {
+		plan, err := decoder.NewDecoderFactory()().CompilePlan(typ)
+		if err != nil {
+			t.Fatalf("could not compile plan: %v", err)
+		}
+		return plan
+	}
+	u32 := &btf.Int{Name: "unsigned int", Size: 4}
+	keyPlan := compile(&btf.Struct{
+		Name: "key_t",
+		Size: 8,
+		Members: []btf.Member{
+			{Name: "daddr", Type: &btf.Typedef{Name: "ipv4_addr", Type: u32}, Offset: 0},
+			{Name: "pid", Type: u32, Offset: 32},
+		},
+	})
+	valuePlan := compile(&btf.Typedef{Name: "duration", Type: &btf.Int{Name: "unsigned long long", Size: 8}})
+	key := make([]byte, 8)
+	copy(key[0:4], []byte{10, 0, 0, 1})
+	decoder.Endianess.PutUint32(key[4:8], 1234)
+	value := make([]byte, 8)
+	decoder.Endianess.PutUint64(value, uint64(time.Second))
+	gauge := &fakeGauge{}
+	l.setHashMapEntry(ctx, keyPlan, valuePlan, key, value, gauge, "gauge_wait", "", 1, watcher)
+
+	if len(watcher.events) != 2 {
+		t.Fatalf("expected 2 events, found %d", len(watcher.events))
+	}
+	ringBufEvent, hashMapEvent := watcher.events[0], watcher.events[1]
+	for field, expected := range map[string]interface{}{
+		"daddr":   net.IPv4(10, 0, 0, 1).To4(),
+		"comm":    "curl",
+		"latency": 3 * time.Millisecond,
+		"bytes":   uint64(4096),
+	} {
+		if found := ringBufEvent.Fields[field]; !reflect.DeepEqual(found, expected) {
+			t.Errorf("expected ring buffer field %s to be %T %v, found %T %v", field, expected, expected, found, found)
+		}
+	}
+	if ringBufEvent.Value != nil {
+		t.Errorf("expected no value for a counted ring buffer event, found %v", ringBufEvent.Value)
+	}
+	for field, expected := range map[string]interface{}{
+		"daddr": net.IPv4(10, 0, 0, 1).To4(),
+		"pid":   uint32(1234),
+	} {
+		if found := hashMapEvent.Fields[field]; !reflect.DeepEqual(found, expected) {
+			t.Errorf("expected hash map key field %s to be %T %v, found %T %v", field, expected, expected, found, found)
+		}
+	}
+	if hashMapEvent.Value != time.Second || hashMapEvent.Poll != 1 {
+		t.Errorf("expected the hash map value to stay a duration, found %T %v", hashMapEvent.Value, hashMapEvent.Value)
+	}
+	if len(gauge.sets) != 1 || gauge.sets[0].value != int64(time.Second) {
+		t.Errorf("expected the instrument to be set to the value in nanoseconds, found %v", gauge.sets)
+	}
+}
+
+func TestPrintHashMapValues(t *testing.T) {
+	ctx := context.Background()
+	l := NewLoader(decoder.NewDecoderFactory(), &fakeMetricsProvider{gauges: map[string]*fakeGauge{}}).(*loader)
+	watcher := &eventRecorder{}
+
+	u32 := &btf.Int{Name: "unsigned int", Size: 4}
+	keyPlan, err := decoder.NewDecoderFactory()().CompilePlan(&btf.Struct{
+		Name:    "key_t",
+		Size:    4,
+		Members: []btf.Member{{Name: "pid", Type: u32, Offset: 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// struct { char comm[4]; duration latency; ... } of fileTestMaps
+	valuePlan := fileTestMaps(t)["print_events"].valuePlan
+	key := make([]byte, 4)
+	decoder.Endianess.PutUint32(key, 1234)
+	value := make([]byte, 24)
+	copy(value[4:8], "curl")
+	decoder.Endianess.PutUint64(value[8:16], uint64(time.Millisecond))
+
+	// print_ maps have no instrument, so values needn't be integers
+	for poll := uint64(1); poll <= 2; poll++ {
+		l.setHashMapEntry(ctx, keyPlan, valuePlan, key, value, nil, "print_latency", "", poll, watcher)
+	}
+
+	if len(watcher.events) != 2 {
+		t.Fatalf("expected an event per poll, found %+v", watcher.events)
+	}
+	fields, ok := watcher.events[1].Value.(map[string]interface{})
+	if !ok || fields["comm"] != "curl" || fields["latency"] != time.Millisecond {
+		t.Errorf("expected the decoded struct as value, found %T %v", watcher.events[1].Value, watcher.events[1].Value)
+	}
+}
@@ -0,0 +1,352 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/solo-io/go-utils/contextutils"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"go.uber.org/zap"
+
+	"github.com/solo-io/bumblebee/pkg/internal/otlp"
+)
+
+const (
+	// Resource attributes identifying the program the logs are from
+	otlpProgramAttribute       = "bee.program.ref"
+	otlpProgramDigestAttribute = "bee.program.digest"
+	// Log record attribute with the name of the map the event is from
+	otlpMapAttribute = "bee.map.name"
+)
+
+type OTLPLogsOpts struct {
+	// Either "grpc" or "http/protobuf"
+	Protocol string
+	// host:port for grpc, or the base URL (e.g. http://localhost:4318) for http/protobuf
+	Endpoint string
+	// Sent with every export, e.g. for authentication
+	Headers map[string]string
+	// Use plaintext instead of TLS for grpc
+	Insecure bool
+	// Attributes of the resource the logs are exported under, e.g. k8s.node.name.
+	// host.name is always set, unless overridden here.
+	ResourceAttributes map[string]string
+	// The location of the program, e.g. its image
+	Program string
+	// The digest of the program's image, if it was pulled from a registry
+	ProgramDigest string
+
+	// Records are exported once this many are batched. Defaults to 512
+	MaxBatchSize int
+	// Batches are exported at least this often, even if not full. Defaults to 5s
+	BatchTimeout time.Duration
+	// Number of batches waiting to be exported, once full new batches are
+	// dropped. Defaults to 16
+	MaxQueueSize int
+	// Failed exports are retried after InitialBackoff, doubling up to
+	// MaxBackoff, until MaxElapsedTime passed. Default to 1s, 30s and 1m
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxElapsedTime time.Duration
+	// How long Close waits for the queued batches to be exported. Defaults to 10s
+	ShutdownTimeout time.Duration
+}
+
+func (o *OTLPLogsOpts) initDefaults() {
+	if o.MaxBatchSize <= 0 {
+		o.MaxBatchSize = 512
+	}
+	if o.BatchTimeout == 0 {
+		o.BatchTimeout = 5 * time.Second
+	}
+	if o.MaxQueueSize <= 0 {
+		o.MaxQueueSize = 16
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.MaxElapsedTime == 0 {
+		o.MaxElapsedTime = time.Minute
+	}
+	if o.ShutdownTimeout == 0 {
+		o.ShutdownTimeout = 10 * time.Second
+	}
+}
+
+// NewOTLPLogsWatcher returns a watcher which exports every event of the print_
+// ring buffer maps as an OTLP log record, with the decoded fields as
+// attributes. Other maps are aggregated into metrics, so they are ignored.
+func NewOTLPLogsWatcher(ctx context.Context, opts *OTLPLogsOpts) (EventWatcher, error) {
+	opts.initDefaults()
+
+	client, err := otlp.NewClient(ctx, &otlp.Opts{
+		Protocol: opts.Protocol,
+		Endpoint: opts.Endpoint,
+		Headers:  opts.Headers,
+		Insecure: opts.Insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{
+		otlpProgramAttribute: opts.Program,
+	}
+	if opts.ProgramDigest != "" {
+		attrs[otlpProgramDigestAttribute] = opts.ProgramDigest
+	}
+	for k, v := range opts.ResourceAttributes {
+		attrs[k] = v
+	}
+
+	exportCtx, cancel := context.WithCancel(context.Background())
+	w := &otlpLogsWatcher{
+		logger:    contextutils.LoggerFrom(ctx),
+		opts:      *opts,
+		client:    client,
+		resource:  otlp.Resource(attrs),
+		printMaps: map[string]bool{},
+		queue:     make(chan []*logspb.LogRecord, opts.MaxQueueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		ctx:       exportCtx,
+		cancel:    cancel,
+	}
+	go w.flushEvery(opts.BatchTimeout)
+	go w.exportQueued()
+	return w, nil
+}
+
+type otlpLogsWatcher struct {
+	logger   *zap.SugaredLogger
+	opts     OTLPLogsOpts
+	client   *otlp.Client
+	resource *resourcepb.Resource
+
+	mu        sync.Mutex
+	printMaps map[string]bool
+	batch     []*logspb.LogRecord
+	closed    bool
+	dropped   uint64
+
+	queue chan []*logspb.LogRecord
+	// Closed to stop flushing on BatchTimeout
+	stop chan struct{}
+	// Closed once all queued batches were exported
+	done chan struct{}
+	// Exports are aborted once this is canceled
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *otlpLogsWatcher) NewRingBuf(name string, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.printMaps[name] = strings.HasPrefix(name, printMapPrefix)
+}
+
+func (w *otlpLogsWatcher) NewHashMap(name string, keys []string) {}
+
+func (w *otlpLogsWatcher) SendEvent(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.printMaps[event.Name] || w.closed {
+		return
+	}
+
+	now := uint64(time.Now().UnixNano())
+	record := &logspb.LogRecord{
+		TimeUnixNano:         now,
+		ObservedTimeUnixNano: now,
+		SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		SeverityText:         "INFO",
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: event.Name}},
+		Attributes:           make([]*commonpb.KeyValue, 0, len(event.Fields)+1),
+	}
+	record.Attributes = append(record.Attributes, &commonpb.KeyValue{
+		Key:   otlpMapAttribute,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: event.Name}},
+	})
+	keys := make([]string, 0, len(event.Fields))
+	for k := range event.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		record.Attributes = append(record.Attributes, &commonpb.KeyValue{
+			Key:   k,
+			Value: otlpValue(event.Fields[k]),
+		})
+	}
+
+	w.batch = append(w.batch, record)
+	if len(w.batch) >= w.opts.MaxBatchSize {
+		w.enqueue()
+	}
+}
+
+// enqueue queues the current batch for export, dropping it if the queue is
+// full. Must be called with mu held.
+func (w *otlpLogsWatcher) enqueue() {
+	if len(w.batch) == 0 {
+		return
+	}
+	select {
+	case w.queue <- w.batch:
+	default:
+		if w.dropped == 0 {
+			w.logger.Warnf("OTLP logs can't be exported fast enough, dropping batches")
+		}
+		w.dropped += uint64(len(w.batch))
+	}
+	w.batch = nil
+}
+
+func (w *otlpLogsWatcher) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			w.enqueue()
+			w.mu.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *otlpLogsWatcher) exportQueued() {
+	defer close(w.done)
+	for batch := range w.queue {
+		if err := w.export(batch); err != nil {
+			w.logger.Errorf("could not export %d OTLP log records: %v", len(batch), err)
+		}
+	}
+}
+
+// export sends a batch, retrying with exponential backoff as long as the
+// failure is retryable and MaxElapsedTime didn't pass
+func (w *otlpLogsWatcher) export(batch []*logspb.LogRecord) error {
+	req := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: w.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      otlp.Scope(),
+				LogRecords: batch,
+			}},
+		}},
+	}
+	deadline := time.Now().Add(w.opts.MaxElapsedTime)
+	backoff := w.opts.InitialBackoff
+	for {
+		err := w.client.ExportLogs(w.ctx, req)
+		if err == nil || !otlp.Retryable(err) {
+			return err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("giving up after %s: %w", w.opts.MaxElapsedTime, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > w.opts.MaxBackoff {
+			backoff = w.opts.MaxBackoff
+		}
+	}
+}
+
+// Close exports the batched records, waiting up to ShutdownTimeout for the queue to drain
+func (w *otlpLogsWatcher) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.stop)
+	w.enqueue()
+	close(w.queue)
+	dropped := w.dropped
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(w.opts.ShutdownTimeout):
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+	w.client.Close()
+	if dropped > 0 {
+		w.logger.Warnf("dropped %d OTLP log records as the export queue was full", dropped)
+	}
+}
+
+// otlpValue converts a decoded value into an attribute value, keeping its type where OTLP has one
+func otlpValue(v interface{}) *commonpb.AnyValue {
+	switch typed := v.(type) {
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: typed}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: typed}}
+	case int8:
+		return otlpInt(int64(typed))
+	case int16:
+		return otlpInt(int64(typed))
+	case int32:
+		return otlpInt(int64(typed))
+	case int64:
+		return otlpInt(typed)
+	case int:
+		return otlpInt(int64(typed))
+	case uint8:
+		return otlpInt(int64(typed))
+	case uint16:
+		return otlpInt(int64(typed))
+	case uint32:
+		return otlpInt(int64(typed))
+	case uint64:
+		if typed > math.MaxInt64 {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(typed)}}
+		}
+		return otlpInt(int64(typed))
+	case float32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: float64(typed)}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: typed}}
+	case []byte:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: typed}}
+	case time.Duration:
+		return otlpInt(int64(typed))
+	case net.IP:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: typed.String()}}
+	case []interface{}:
+		values := make([]*commonpb.AnyValue, 0, len(typed))
+		for _, elem := range typed {
+			values = append(values, otlpValue(elem))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: formatStructured(v)}}
+}
+
+func otlpInt(v int64) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+}
@@ -0,0 +1,107 @@
+package loader
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPLogsWatcher(t *testing.T) {
+	var requests int32
+	received := make(chan *collogspb.ExportLogsServiceRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		// the first export fails, and is retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &collogspb.ExportLogsServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("could not unmarshal export request: %v", err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	watcher, err := NewOTLPLogsWatcher(context.Background(), &OTLPLogsOpts{
+		Protocol:       "http/protobuf",
+		Endpoint:       collector.URL,
+		Program:        "ghcr.io/solo-io/bumblebee/tcpconnect:0.0.9",
+		ProgramDigest:  "sha256:abc",
+		MaxBatchSize:   2,
+		BatchTimeout:   time.Hour,
+		InitialBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.NewRingBuf("print_events", []string{"daddr", "latency"})
+	watcher.NewRingBuf("counter_events", []string{"daddr"})
+	watcher.NewHashMap("sizes", []string{"pid"})
+
+	fields := map[string]interface{}{"daddr": net.ParseIP("10.0.0.1"), "latency": 3 * time.Millisecond}
+	watcher.SendEvent(Event{Name: "print_events", Fields: fields})
+	// only print maps are exported
+	watcher.SendEvent(Event{Name: "counter_events", Fields: fields})
+	watcher.SendEvent(Event{Name: "sizes", Fields: map[string]interface{}{"pid": uint32(1)}, Value: uint64(5)})
+	// a full batch is exported right away
+	watcher.SendEvent(Event{Name: "print_events", Fields: fields})
+
+	var req *collogspb.ExportLogsServiceRequest
+	select {
+	case req = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export received")
+	}
+	resourceAttrs := map[string]string{}
+	for _, attr := range req.ResourceLogs[0].Resource.Attributes {
+		resourceAttrs[attr.Key] = attr.Value.GetStringValue()
+	}
+	if resourceAttrs[otlpProgramAttribute] != "ghcr.io/solo-io/bumblebee/tcpconnect:0.0.9" ||
+		resourceAttrs[otlpProgramDigestAttribute] != "sha256:abc" || resourceAttrs["host.name"] == "" {
+		t.Errorf("expected the host and program in the resource, found %v", resourceAttrs)
+	}
+
+	records := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		t.Fatalf("expected 2 log records, found %d", len(records))
+	}
+	attrs := map[string]*commonpb.AnyValue{}
+	for _, attr := range records[0].Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	if attrs[otlpMapAttribute].GetStringValue() != "print_events" {
+		t.Errorf("expected the map name, found %v", attrs[otlpMapAttribute])
+	}
+	if attrs["daddr"].GetStringValue() != "10.0.0.1" {
+		t.Errorf("expected the address as a string, found %v", attrs["daddr"])
+	}
+	if attrs["latency"].GetIntValue() != int64(3*time.Millisecond) {
+		t.Errorf("expected the latency in nanoseconds, found %v", attrs["latency"])
+	}
+
+	// the rest is exported on close
+	watcher.SendEvent(Event{Name: "print_events", Fields: fields})
+	watcher.Close()
+	select {
+	case req = <-received:
+	default:
+		t.Fatal("expected the last batch to be exported on close")
+	}
+	if records := req.ResourceLogs[0].ScopeLogs[0].LogRecords; len(records) != 1 {
+		t.Errorf("expected 1 log record, found %d", len(records))
+	}
+}
@@ -11,6 +11,9 @@ type MapEntry struct {
 	Entry KvPair
 }
 
+// MapWatcher receives map entries with every value already rendered as a string.
+// It is set as LoadOptions.Watcher, or adapted with NewStringWatcher to be
+// passed to WatchMaps.
 type MapWatcher interface {
 	NewRingBuf(name string, keys []string)
 	NewHashMap(name string, keys []string)
@@ -18,6 +21,65 @@ type MapWatcher interface {
 	Close()
 }
 
+// Event is a single ring buffer record, or hash map entry, with its values as
+// decoded, e.g. uint64, time.Duration, net.IP or time.Time, so that each
+// watcher can format them as it sees fit.
+type Event struct {
+	// Name of the map the event is from
+	Name string
+	// The decoded ring buffer record, or the decoded hash map key.
+	// Fields is reused once SendEvent returns, watchers which hold on to it must copy it.
+	Fields map[string]interface{}
+	// The hash map value, or the value used for the metric of ring buffers
+	// which have one; nil otherwise
+	Value interface{}
+	// Counts the polls of a hash map, the entries of the same poll share it.
+	// It is 0 for ring buffers.
+	Poll uint64
+}
+
+type EventWatcher interface {
+	NewRingBuf(name string, keys []string)
+	NewHashMap(name string, keys []string)
+	SendEvent(event Event)
+	Close()
+}
+
+// NewStringWatcher adapts a MapWatcher to receive events from the loader,
+// rendering their values for display.
+func NewStringWatcher(watcher MapWatcher) EventWatcher {
+	return &stringWatcher{watcher: watcher}
+}
+
+type stringWatcher struct {
+	watcher MapWatcher
+}
+
+func (w *stringWatcher) NewRingBuf(name string, keys []string) {
+	w.watcher.NewRingBuf(name, keys)
+}
+func (w *stringWatcher) NewHashMap(name string, keys []string) {
+	w.watcher.NewHashMap(name, keys)
+}
+func (w *stringWatcher) SendEvent(event Event) {
+	entry := KvPair{
+		Key: make(map[string]string, len(event.Fields)),
+	}
+	for k, v := range event.Fields {
+		entry.Key[k] = formatForDisplay(v)
+	}
+	if event.Value != nil {
+		entry.Value = formatForDisplay(event.Value)
+	}
+	w.watcher.SendEntry(MapEntry{
+		Name:  event.Name,
+		Entry: entry,
+	})
+}
+func (w *stringWatcher) Close() {
+	w.watcher.Close()
+}
+
 type noopWatcher struct{}
 
 func (w *noopWatcher) NewRingBuf(name string, keys []string) {
@@ -29,6 +91,9 @@ func (w *noopWatcher) NewHashMap(name string, keys []string) {
 func (w *noopWatcher) SendEntry(entry MapEntry) {
 	// noop
 }
+func (w *noopWatcher) SendEvent(event Event) {
+	// noop
+}
 func (w *noopWatcher) Close() {
 	// noop
 }
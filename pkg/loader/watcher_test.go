@@ -0,0 +1,48 @@
+package loader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// entryRecorder is a MapWatcher which keeps every entry
+type entryRecorder struct {
+	entries []MapEntry
+	closed  bool
+}
+
+func (r *entryRecorder) NewRingBuf(name string, keys []string) {}
+func (r *entryRecorder) NewHashMap(name string, keys []string) {}
+func (r *entryRecorder) SendEntry(entry MapEntry)              { r.entries = append(r.entries, entry) }
+func (r *entryRecorder) Close()                                { r.closed = true }
+
+func TestLoadOptionsWatcher(t *testing.T) {
+	recorder := &entryRecorder{}
+	opts := &LoadOptions{Watcher: recorder}
+	watcher := opts.eventWatcher()
+	watcher.SendEvent(Event{
+		Name:   "hist_latency",
+		Fields: map[string]interface{}{"pid": uint32(1234)},
+		Value:  1500 * time.Microsecond,
+	})
+	watcher.Close()
+
+	// the map watcher receives the entry rendered for display
+	expected := []MapEntry{{
+		Name:  "hist_latency",
+		Entry: KvPair{Key: map[string]string{"pid": "1234"}, Value: "1.5ms"},
+	}}
+	if !reflect.DeepEqual(recorder.entries, expected) || !recorder.closed {
+		t.Errorf("expected %+v to reach the map watcher, found %+v", expected, recorder.entries)
+	}
+
+	events := &eventRecorder{}
+	opts.EventWatcher = events
+	if opts.eventWatcher() != events {
+		t.Errorf("expected the event watcher to take precedence over the map watcher")
+	}
+	if _, ok := (&LoadOptions{}).eventWatcher().(*noopWatcher); !ok {
+		t.Errorf("expected events to be dropped without a watcher")
+	}
+}
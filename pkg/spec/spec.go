@@ -30,6 +30,8 @@ type EbpfPackage struct {
 	Authors string
 	// Platform this was built on
 	Platform *ocispec.Platform
+	// Digest of the image manifest, set when pulled
+	Digest digest.Digest
 	// Nested config object
 	EbpfConfig
 }
@@ -162,6 +164,7 @@ func (e *ebpfOCIClient) Pull(
 		Authors:          manifest.Annotations[ocispec.AnnotationAuthors],
 		EbpfConfig:       cfg,
 		Platform:         manifestDesc.Platform,
+		Digest:           manifestDesc.Digest,
 	}, nil
 }
 
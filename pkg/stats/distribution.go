@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"math"
+	"time"
+)
+
+// NativeHistogramOpts configures a histogram whose buckets grow exponentially,
+// a Prometheus native histogram or an OTLP exponential histogram, so that no
+// bucket limits need to be picked up front
+type NativeHistogramOpts struct {
+	// Each bucket is at most this much wider than the previous one. Defaults to 1.1
+	BucketFactor float64
+	// The resolution is reduced to stay within this many buckets. Defaults to 160
+	MaxBuckets uint32
+	// If set, these classic buckets are kept as well, for scrapers which
+	// don't support native histograms
+	ClassicBuckets []float64
+}
+
+func (o *NativeHistogramOpts) initDefaults() {
+	if o.BucketFactor <= 1 {
+		o.BucketFactor = 1.1
+	}
+	if o.MaxBuckets == 0 {
+		o.MaxBuckets = 160
+	}
+}
+
+// SummaryOpts configures a summary, which exports quantiles of the observed values
+type SummaryOpts struct {
+	// Quantiles to export, e.g. 0.99. Defaults to 0.5, 0.9 and 0.99
+	Quantiles []float64
+	// Quantiles are computed over the values observed within this window.
+	// Defaults to 10m
+	MaxAge time.Duration
+}
+
+func (o *SummaryOpts) initDefaults() {
+	if len(o.Quantiles) == 0 {
+		o.Quantiles = []float64{0.5, 0.9, 0.99}
+	}
+	if o.MaxAge == 0 {
+		o.MaxAge = 10 * time.Minute
+	}
+}
+
+// objectives returns the allowed error of each quantile, tighter towards the
+// tails, e.g. 0.5: 0.05, 0.9: 0.01 and 0.99: 0.001
+func (o *SummaryOpts) objectives() map[float64]float64 {
+	objectives := make(map[float64]float64, len(o.Quantiles))
+	for _, q := range o.Quantiles {
+		objectives[q] = math.Min(q, 1-q) / 10
+	}
+	return objectives
+}
+
+// exponentialScale returns the largest scale, as in OTLP exponential
+// histograms, whose buckets grow by at most factor. Prometheus native
+// histograms pick their schema the same way.
+func exponentialScale(factor float64) int32 {
+	// Buckets grow by 2^(2^-scale)
+	scale := int32(math.Ceil(math.Log2(1 / math.Log2(factor))))
+	if scale > 8 {
+		scale = 8
+	}
+	if scale < -4 {
+		scale = -4
+	}
+	return scale
+}
+
+// exponentialIndex returns the index of the bucket of a positive value at
+// scale, the bucket covers (base^index, base^(index+1)]
+func exponentialIndex(val float64, scale int32) int32 {
+	return int32(math.Ceil(math.Ldexp(math.Log2(val), int(scale)))) - 1
+}
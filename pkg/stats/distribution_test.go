@@ -0,0 +1,40 @@
+package stats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestExponentialBuckets(t *testing.T) {
+	if scale := exponentialScale(1.1); scale != 3 {
+		t.Errorf("expected scale 3 for a factor of 1.1, found %d", scale)
+	}
+	if scale := exponentialScale(2); scale != 0 {
+		t.Errorf("expected scale 0 for a factor of 2, found %d", scale)
+	}
+	// at scale 0 buckets are (2^i, 2^(i+1)], so powers of two are the upper bound
+	for val, expected := range map[float64]int32{1: -1, 1.5: 0, 2: 0, 3: 1, 4: 1, 0.5: -2} {
+		if index := exponentialIndex(val, 0); index != expected {
+			t.Errorf("expected %v to be in bucket %d, found %d", val, expected, index)
+		}
+	}
+
+	ctx := context.Background()
+	h := &otlpExponentialHistogram{
+		series:     &otlpSeriesSet{desc: metricDesc{scale: 1}, series: map[uint64]*otlpSeries{}},
+		scale:      0,
+		maxBuckets: 2,
+	}
+	for _, val := range []int64{0, 2, 3, 5} {
+		h.Set(ctx, val, map[string]string{})
+	}
+	// buckets 0, 1 and 2 don't fit, so they are merged into 0 and 1 at scale -1
+	point := h.collect(0, 0).GetExponentialHistogram().DataPoints[0]
+	if point.Scale != -1 || point.ZeroCount != 1 || point.Count != 4 || point.GetSum() != 10 {
+		t.Fatalf("unexpected data point %v", point)
+	}
+	if point.Positive.Offset != 0 || !reflect.DeepEqual(point.Positive.BucketCounts, []uint64{2, 1}) {
+		t.Errorf("expected merged buckets [2 1] from 0, found %v from %d", point.Positive.BucketCounts, point.Positive.Offset)
+	}
+}
@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// expirer is a metric whose series can be removed once they are stale
+type expirer interface {
+	// expire removes the series which weren't updated since before
+	expire(before time.Time)
+}
+
+// expireSeries removes the series which weren't updated within ttl from the
+// metrics returned by metrics, until ctx is done. Series are checked twice
+// per ttl, so a series is removed at most 1.5 ttl after its last update.
+func expireSeries(ctx context.Context, ttl time.Duration, metrics func() []expirer) {
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			before := now.Add(-ttl)
+			for _, metric := range metrics() {
+				metric.expire(before)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expirerList holds the metrics of a provider which can expire
+type expirerList struct {
+	mu       sync.Mutex
+	expirers []expirer
+}
+
+func (l *expirerList) add(e expirer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expirers = append(l.expirers, e)
+}
+
+func (l *expirerList) list() []expirer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]expirer(nil), l.expirers...)
+}
+
+// seriesTracker records when each series of a metric was last updated. A nil
+// tracker tracks nothing, which is used when series never expire.
+type seriesTracker struct {
+	mu     sync.Mutex
+	series map[uint64]*trackedSeries
+}
+
+type trackedSeries struct {
+	hash    uint64
+	labels  map[string]string
+	updated time.Time
+}
+
+func newSeriesTracker(ttl time.Duration) *seriesTracker {
+	if ttl == 0 {
+		return nil
+	}
+	return &seriesTracker{series: map[uint64]*trackedSeries{}}
+}
+
+// touch records an update of the series with the given labels
+func (t *seriesTracker) touch(labels map[string]string) {
+	if t == nil {
+		return
+	}
+	t.touchHash(hashLabels(labels), labels)
+}
+
+// touchHash is touch for callers which already hashed the labels
+func (t *seriesTracker) touchHash(keyHash uint64, labels map[string]string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if series, ok := t.series[keyHash]; ok {
+		series.updated = now
+		return
+	}
+	t.series[keyHash] = &trackedSeries{hash: keyHash, labels: labels, updated: now}
+}
+
+// expire forgets, and returns, the series which weren't updated since before
+func (t *seriesTracker) expire(before time.Time) []*trackedSeries {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var stale []*trackedSeries
+	for keyHash, series := range t.series {
+		if series.updated.Before(before) {
+			stale = append(stale, series)
+			delete(t.series, keyHash)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,161 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+)
+
+// NamingOpts controls how metrics are named and described. It applies to
+// every MetricsProvider, so the same program exports the same metrics
+// whichever way they are sent.
+type NamingOpts struct {
+	// Prepended to the name of every metric, defaults to ebpf_solo_io
+	Namespace string
+	// Added to every metric, e.g. the node, cluster or image the program runs on.
+	// Labels of the metric itself take precedence.
+	ConstLabels map[string]string
+	// Per metric settings, keyed by the name of the map the metric comes from
+	Metrics map[string]MetricOpts
+}
+
+type MetricOpts struct {
+	// Replaces the name of the map as the name of the metric
+	Name string
+	// Describes the metric, e.g. in Prometheus' HELP
+	Help string
+	// Unit of the values, e.g. "seconds" or "bytes". It is appended to the
+	// name unless the name already ends with it.
+	Unit string
+}
+
+// Unit is the unit of the raw values handed to an instrument, which decides
+// the unit they are exported in
+type Unit string
+
+const (
+	// Values are exported as they are
+	UnitNone Unit = ""
+	// Values are exported in seconds, with a _seconds suffix
+	UnitNanoseconds Unit = "nanoseconds"
+	// Values are exported with a _bytes suffix
+	UnitBytes Unit = "bytes"
+)
+
+// exported returns the name of the unit values are exported in, and what
+// raw values are multiplied by to get there
+func (u Unit) exported() (string, float64) {
+	switch u {
+	case UnitNanoseconds:
+		return "seconds", 1e-9
+	case UnitBytes:
+		return "bytes", 1
+	default:
+		return "", 1
+	}
+}
+
+// Validate checks that the names and labels are valid in Prometheus, which
+// would otherwise refuse to register the metrics
+func (n *NamingOpts) Validate() error {
+	if n.Namespace != "" && !model.IsValidMetricName(model.LabelValue(n.Namespace)) {
+		return fmt.Errorf("invalid metric namespace '%s'", n.Namespace)
+	}
+	for k, v := range n.ConstLabels {
+		// Labels starting with __ are reserved for Prometheus' own use
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid const label name '%s'", k)
+		}
+		if !utf8.ValidString(v) {
+			return fmt.Errorf("value of const label '%s' is not valid UTF-8", k)
+		}
+	}
+	mapNames := make([]string, 0, len(n.Metrics))
+	for mapName := range n.Metrics {
+		mapNames = append(mapNames, mapName)
+	}
+	sort.Strings(mapNames)
+	for _, mapName := range mapNames {
+		opts := n.Metrics[mapName]
+		if opts.Name != "" && !model.IsValidMetricName(model.LabelValue(opts.Name)) {
+			return fmt.Errorf("invalid metric name '%s' for map '%s'", opts.Name, mapName)
+		}
+		if opts.Unit != "" && !model.IsValidMetricName(model.LabelValue("_"+opts.Unit)) {
+			return fmt.Errorf("invalid metric unit '%s' for map '%s'", opts.Unit, mapName)
+		}
+	}
+	return nil
+}
+
+func (n *NamingOpts) initDefaults() {
+	if n.Namespace == "" {
+		n.Namespace = ebpfNamespace
+	}
+}
+
+// metricDesc is how a single metric is named and described
+type metricDesc struct {
+	// Name of the metric without the namespace
+	name string
+	help string
+	unit string
+	// What raw values are multiplied by before they are exported
+	scale float64
+	// Const labels which don't clash with the labels of the metric
+	constLabels map[string]string
+}
+
+func (n *NamingOpts) describe(name string, labels []string, unit Unit) metricDesc {
+	opts := n.Metrics[name]
+	desc := metricDesc{
+		name: name,
+		help: opts.Help,
+		unit: opts.Unit,
+	}
+	// A configured unit only names the metric, values are still converted
+	exportedUnit, scale := unit.exported()
+	desc.scale = scale
+	if desc.unit == "" {
+		desc.unit = exportedUnit
+	}
+	if opts.Name != "" {
+		desc.name = opts.Name
+	}
+	if desc.unit != "" && !strings.HasSuffix(desc.name, "_"+desc.unit) {
+		desc.name += "_" + desc.unit
+	}
+
+	if len(n.ConstLabels) > 0 {
+		desc.constLabels = make(map[string]string, len(n.ConstLabels))
+		for k, v := range n.ConstLabels {
+			desc.constLabels[k] = v
+		}
+		for _, label := range labels {
+			delete(desc.constLabels, label)
+		}
+	}
+	return desc
+}
+
+// value converts a raw value into the unit it is exported in
+func (d *metricDesc) value(raw float64) float64 {
+	return raw * d.scale
+}
+
+// withConstLabels returns labels with the const labels of the metric added
+func (d *metricDesc) withConstLabels(labels map[string]string) map[string]string {
+	if len(d.constLabels) == 0 {
+		return labels
+	}
+	all := make(map[string]string, len(labels)+len(d.constLabels))
+	for k, v := range d.constLabels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	return all
+}
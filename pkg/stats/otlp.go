@@ -0,0 +1,701 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+	"github.com/mitchellh/hashstructure/v2"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	"github.com/solo-io/bumblebee/pkg/internal/otlp"
+	"github.com/solo-io/go-utils/contextutils"
+)
+
+type OTLPOpts struct {
+	// Either "grpc" or "http/protobuf"
+	Protocol string
+	// host:port for grpc, or the base URL (e.g. http://localhost:4318) for http/protobuf
+	Endpoint string
+	// Sent with every export, e.g. for authentication
+	Headers map[string]string
+	// Use plaintext instead of TLS for grpc
+	Insecure bool
+	// How often metrics are exported, they are also exported once more on shutdown
+	ExportInterval time.Duration
+	// Attributes of the resource the metrics are exported under, e.g. k8s.node.name
+	ResourceAttributes map[string]string
+	Naming             NamingOpts
+	// Series which weren't updated for this long are no longer exported, 0 keeps them forever
+	SeriesTTL time.Duration
+}
+
+func (o *OTLPOpts) initDefaults() {
+	if o.ExportInterval == 0 {
+		o.ExportInterval = 15 * time.Second
+	}
+	o.Naming.initDefaults()
+}
+
+// NewOTLPMetricsProvider returns a MetricsProvider which aggregates metrics in
+// memory and periodically exports them, with cumulative temporality, to an
+// OTLP endpoint such as an OpenTelemetry collector.
+func NewOTLPMetricsProvider(ctx context.Context, opts *OTLPOpts) (MetricsProvider, error) {
+	opts.initDefaults()
+
+	client, err := otlp.NewClient(ctx, &otlp.Opts{
+		Protocol: opts.Protocol,
+		Endpoint: opts.Endpoint,
+		Headers:  opts.Headers,
+		Insecure: opts.Insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &otlpMetricsProvider{
+		client:    client,
+		resource:  opts.ResourceAttributes,
+		naming:    opts.Naming,
+		startTime: time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	m.counterResets = m.NewIncrementCounter(counterResetsMetricName, []string{"map"}, UnitNone)
+	if opts.SeriesTTL > 0 {
+		go expireSeries(ctx, opts.SeriesTTL, m.expirers)
+	}
+
+	go m.exportEvery(ctx, opts.ExportInterval)
+
+	return m, nil
+}
+
+type otlpMetricsProvider struct {
+	client    *otlp.Client
+	resource  map[string]string
+	naming    NamingOpts
+	startTime time.Time
+
+	counterResets IncrementInstrument
+
+	mu      sync.Mutex
+	metrics []otlpMetric
+
+	stopOnce sync.Once
+	// Closed to export once more and stop
+	stop chan struct{}
+	// Closed once the last export is done
+	done chan struct{}
+}
+
+// exportEvery exports the metrics on an interval, and once more when ctx is
+// done or the provider is shut down
+func (m *otlpMetricsProvider) exportEvery(ctx context.Context, interval time.Duration) {
+	defer close(m.done)
+	logger := contextutils.LoggerFrom(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.export(ctx); err != nil {
+				logger.Errorf("could not export OTLP metrics: %v", err)
+			}
+			continue
+		case <-ctx.Done():
+		case <-m.stop:
+		}
+		// Export whatever was collected since the last tick, ctx may be
+		// done already so this needs a context of its own. The export is
+		// bounded by the timeout of the client.
+		if err := m.export(context.Background()); err != nil {
+			logger.Errorf("could not export OTLP metrics on shutdown: %v", err)
+		}
+		m.client.Close()
+		return
+	}
+}
+
+// Shutdown exports the metrics once more, unless that already happened as
+// the context of the provider is done, and waits for the export to complete
+func (m *otlpMetricsProvider) Shutdown(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("metrics were not exported on shutdown: %w", ctx.Err())
+	}
+}
+
+// otlpMetric is an instrument which can be collected into an OTLP metric
+type otlpMetric interface {
+	expirer
+	collect(start, now uint64) *metricspb.Metric
+}
+
+func (m *otlpMetricsProvider) NewSetCounter(name string, labels []string, unit Unit) SetInstrument {
+	c := &otlpSetCounter{
+		name:   name,
+		series: m.newSeriesSet(name, labels, unit),
+		last:   map[uint64]int64{},
+		resets: m.counterResets,
+	}
+	m.add(c)
+	return c
+}
+
+func (m *otlpMetricsProvider) NewIncrementCounter(name string, labels []string, unit Unit) IncrementInstrument {
+	c := &otlpIncrementCounter{series: m.newSeriesSet(name, labels, unit)}
+	m.add(c)
+	return c
+}
+
+func (m *otlpMetricsProvider) NewGauge(name string, labels []string, unit Unit) SetInstrument {
+	g := &otlpGauge{series: m.newSeriesSet(name, labels, unit)}
+	m.add(g)
+	return g
+}
+
+func (m *otlpMetricsProvider) NewHistogram(name string, labels []string, buckets []float64, unit Unit) SetInstrument {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	h := &otlpHistogram{series: m.newSeriesSet(name, labels, unit), bounds: bounds}
+	m.add(h)
+	return h
+}
+
+func (m *otlpMetricsProvider) NewNativeHistogram(name string, labels []string, opts NativeHistogramOpts, unit Unit) SetInstrument {
+	opts.initDefaults()
+	// The classic buckets only matter to Prometheus scrapers
+	h := &otlpExponentialHistogram{
+		series:     m.newSeriesSet(name, labels, unit),
+		scale:      exponentialScale(opts.BucketFactor),
+		maxBuckets: int32(opts.MaxBuckets),
+	}
+	m.add(h)
+	return h
+}
+
+func (m *otlpMetricsProvider) NewSummary(name string, labels []string, opts SummaryOpts, unit Unit) SetInstrument {
+	opts.initDefaults()
+	s := &otlpSummary{
+		series: m.newSeriesSet(name, labels, unit),
+		opts:   opts,
+	}
+	m.add(s)
+	return s
+}
+
+func (m *otlpMetricsProvider) resetsInstrument() IncrementInstrument {
+	return m.counterResets
+}
+
+func (m *otlpMetricsProvider) add(metric otlpMetric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, metric)
+}
+
+func (m *otlpMetricsProvider) expirers() []expirer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expirers := make([]expirer, 0, len(m.metrics))
+	for _, metric := range m.metrics {
+		expirers = append(expirers, metric)
+	}
+	return expirers
+}
+
+func (m *otlpMetricsProvider) export(ctx context.Context) error {
+	start := uint64(m.startTime.UnixNano())
+	now := uint64(time.Now().UnixNano())
+
+	m.mu.Lock()
+	metrics := make([]*metricspb.Metric, 0, len(m.metrics))
+	for _, metric := range m.metrics {
+		if collected := metric.collect(start, now); collected != nil {
+			metrics = append(metrics, collected)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	return m.client.ExportMetrics(ctx, &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: otlp.Resource(m.resource),
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   otlp.Scope(),
+				Metrics: metrics,
+			}},
+		}},
+	})
+}
+
+// otlpSeries holds the aggregated state of a single label set
+type otlpSeries struct {
+	attrs   []*commonpb.KeyValue
+	updated time.Time
+
+	value float64
+	// histograms only
+	count   uint64
+	buckets []uint64
+	// exponential histograms only, buckets by their index at scale
+	scale     int32
+	zeroCount uint64
+	positive  map[int32]uint64
+	negative  map[int32]uint64
+	// summaries only, values observed since windowStart
+	stream      *quantile.Stream
+	windowStart time.Time
+}
+
+// otlpSeriesSet holds all label sets observed for a single metric
+type otlpSeriesSet struct {
+	name string
+	desc metricDesc
+
+	mu     sync.Mutex
+	series map[uint64]*otlpSeries
+}
+
+func (m *otlpMetricsProvider) newSeriesSet(name string, labels []string, unit Unit) *otlpSeriesSet {
+	desc := m.naming.describe(name, labels, unit)
+	return &otlpSeriesSet{
+		name:   m.naming.Namespace + "_" + desc.name,
+		desc:   desc,
+		series: map[uint64]*otlpSeries{},
+	}
+}
+
+// metric describes a metric, the caller sets its data
+func (s *otlpSeriesSet) metric() *metricspb.Metric {
+	return &metricspb.Metric{
+		Name:        s.name,
+		Description: s.desc.help,
+		Unit:        ucumUnit(s.desc.unit),
+	}
+}
+
+// ucumUnit returns the UCUM code OTLP expects for the units metrics are
+// exported in, other units are passed on as they are
+func ucumUnit(unit string) string {
+	switch unit {
+	case "seconds":
+		return "s"
+	case "bytes":
+		return "By"
+	default:
+		return unit
+	}
+}
+
+// get must be called with s.mu held
+func (s *otlpSeriesSet) get(labels map[string]string) (*otlpSeries, uint64) {
+	keyHash, err := hashstructure.Hash(labels, hashstructure.FormatV2, nil)
+	if err != nil {
+		log.Fatal("This should never happen")
+	}
+	series, ok := s.series[keyHash]
+	if !ok {
+		series = &otlpSeries{attrs: otlp.Attributes(s.desc.withConstLabels(labels))}
+		s.series[keyHash] = series
+	}
+	series.updated = time.Now()
+	return series, keyHash
+}
+
+// expire removes the series which weren't updated since before, returning their hashes
+func (s *otlpSeriesSet) expire(before time.Time) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stale []uint64
+	for keyHash, series := range s.series {
+		if series.updated.Before(before) {
+			stale = append(stale, keyHash)
+			delete(s.series, keyHash)
+		}
+	}
+	return stale
+}
+
+// numberDataPoints must be called with s.mu held
+func (s *otlpSeriesSet) numberDataPoints(start, now uint64) []*metricspb.NumberDataPoint {
+	points := make([]*metricspb.NumberDataPoint, 0, len(s.series))
+	for _, series := range s.series {
+		points = append(points, &metricspb.NumberDataPoint{
+			Attributes:        series.attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: series.value},
+		})
+	}
+	return points
+}
+
+func (s *otlpSeriesSet) collectSum(start, now uint64) *metricspb.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.series) == 0 {
+		return nil
+	}
+	metric := s.metric()
+	metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		IsMonotonic:            true,
+		DataPoints:             s.numberDataPoints(start, now),
+	}}
+	return metric
+}
+
+type otlpSetCounter struct {
+	name   string
+	series *otlpSeriesSet
+	// Last value of the map entry behind each series, keyed like series
+	last   map[uint64]int64
+	resets IncrementInstrument
+}
+
+func (c *otlpSetCounter) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	c.series.mu.Lock()
+	series, keyHash := c.series.get(decodedKey)
+	oldVal := c.last[keyHash]
+	c.last[keyHash] = intVal
+	// The sum keeps growing when map entries start over, so it stays cumulative
+	diff, reset := counterDelta(oldVal, intVal)
+	series.value += c.series.desc.value(float64(diff))
+	c.series.mu.Unlock()
+
+	if reset {
+		c.resets.Increment(ctx, map[string]string{"map": c.name})
+	}
+}
+
+func (c *otlpSetCounter) expire(before time.Time) {
+	stale := c.series.expire(before)
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	for _, keyHash := range stale {
+		delete(c.last, keyHash)
+	}
+}
+
+func (c *otlpSetCounter) collect(start, now uint64) *metricspb.Metric {
+	return c.series.collectSum(start, now)
+}
+
+type otlpIncrementCounter struct {
+	series *otlpSeriesSet
+}
+
+func (i *otlpIncrementCounter) Increment(
+	ctx context.Context,
+	decodedKey map[string]string,
+) {
+	i.series.mu.Lock()
+	defer i.series.mu.Unlock()
+	series, _ := i.series.get(decodedKey)
+	series.value++
+}
+
+func (i *otlpIncrementCounter) Add(
+	ctx context.Context,
+	val int64,
+	decodedKey map[string]string,
+) {
+	i.series.mu.Lock()
+	defer i.series.mu.Unlock()
+	series, _ := i.series.get(decodedKey)
+	series.value += i.series.desc.value(float64(val))
+}
+
+func (i *otlpIncrementCounter) expire(before time.Time) {
+	i.series.expire(before)
+}
+
+func (i *otlpIncrementCounter) collect(start, now uint64) *metricspb.Metric {
+	return i.series.collectSum(start, now)
+}
+
+type otlpGauge struct {
+	series *otlpSeriesSet
+}
+
+func (g *otlpGauge) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	series, _ := g.series.get(decodedKey)
+	series.value = g.series.desc.value(float64(intVal))
+}
+
+func (g *otlpGauge) expire(before time.Time) {
+	g.series.expire(before)
+}
+
+func (g *otlpGauge) collect(start, now uint64) *metricspb.Metric {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	if len(g.series.series) == 0 {
+		return nil
+	}
+	metric := g.series.metric()
+	metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+		DataPoints: g.series.numberDataPoints(start, now),
+	}}
+	return metric
+}
+
+type otlpHistogram struct {
+	series *otlpSeriesSet
+	// Upper bounds of the buckets, there is one more bucket for values above the last bound
+	bounds []float64
+}
+
+func (h *otlpHistogram) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	series, _ := h.series.get(decodedKey)
+	if series.buckets == nil {
+		series.buckets = make([]uint64, len(h.bounds)+1)
+	}
+	val := h.series.desc.value(float64(intVal))
+	// Buckets are upper bound inclusive, like Prometheus' le
+	series.buckets[sort.SearchFloat64s(h.bounds, val)]++
+	series.count++
+	series.value += val
+}
+
+func (h *otlpHistogram) expire(before time.Time) {
+	h.series.expire(before)
+}
+
+func (h *otlpHistogram) collect(start, now uint64) *metricspb.Metric {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	if len(h.series.series) == 0 {
+		return nil
+	}
+	points := make([]*metricspb.HistogramDataPoint, 0, len(h.series.series))
+	for _, series := range h.series.series {
+		sum := series.value
+		points = append(points, &metricspb.HistogramDataPoint{
+			Attributes:        series.attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Count:             series.count,
+			Sum:               &sum,
+			BucketCounts:      append([]uint64(nil), series.buckets...),
+			ExplicitBounds:    h.bounds,
+		})
+	}
+	metric := h.series.metric()
+	metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		DataPoints:             points,
+	}}
+	return metric
+}
+
+type otlpExponentialHistogram struct {
+	series *otlpSeriesSet
+	// Initial scale of every series, which is reduced once a series has
+	// more than maxBuckets buckets
+	scale      int32
+	maxBuckets int32
+}
+
+func (h *otlpExponentialHistogram) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	series, _ := h.series.get(decodedKey)
+	if series.positive == nil {
+		series.scale = h.scale
+		series.positive = map[int32]uint64{}
+		series.negative = map[int32]uint64{}
+	}
+	val := h.series.desc.value(float64(intVal))
+	series.count++
+	series.value += val
+	switch {
+	case val > 0:
+		series.positive[exponentialIndex(val, series.scale)]++
+	case val < 0:
+		series.negative[exponentialIndex(-val, series.scale)]++
+	default:
+		series.zeroCount++
+	}
+	for bucketSpan(series.positive) > h.maxBuckets || bucketSpan(series.negative) > h.maxBuckets {
+		downscale(series)
+	}
+}
+
+// bucketSpan returns how many buckets are needed to send buckets, which
+// are sent as a dense range from the lowest to the highest index
+func bucketSpan(buckets map[int32]uint64) int32 {
+	if len(buckets) == 0 {
+		return 0
+	}
+	first, last := bucketRange(buckets)
+	return last - first + 1
+}
+
+func bucketRange(buckets map[int32]uint64) (first, last int32) {
+	first, last = math.MaxInt32, math.MinInt32
+	for index := range buckets {
+		if index < first {
+			first = index
+		}
+		if index > last {
+			last = index
+		}
+	}
+	return first, last
+}
+
+// downscale halves the resolution of series, merging each pair of buckets
+func downscale(series *otlpSeries) {
+	series.scale--
+	for _, buckets := range []map[int32]uint64{series.positive, series.negative} {
+		merged := make(map[int32]uint64, len(buckets))
+		for index, count := range buckets {
+			// >> rounds towards negative infinity, as the index mapping requires
+			merged[index>>1] += count
+		}
+		for index := range buckets {
+			delete(buckets, index)
+		}
+		for index, count := range merged {
+			buckets[index] = count
+		}
+	}
+}
+
+func denseBuckets(buckets map[int32]uint64) *metricspb.ExponentialHistogramDataPoint_Buckets {
+	if len(buckets) == 0 {
+		return nil
+	}
+	first, last := bucketRange(buckets)
+	counts := make([]uint64, last-first+1)
+	for index, count := range buckets {
+		counts[index-first] = count
+	}
+	return &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: first, BucketCounts: counts}
+}
+
+func (h *otlpExponentialHistogram) expire(before time.Time) {
+	h.series.expire(before)
+}
+
+func (h *otlpExponentialHistogram) collect(start, now uint64) *metricspb.Metric {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	if len(h.series.series) == 0 {
+		return nil
+	}
+	points := make([]*metricspb.ExponentialHistogramDataPoint, 0, len(h.series.series))
+	for _, series := range h.series.series {
+		sum := series.value
+		points = append(points, &metricspb.ExponentialHistogramDataPoint{
+			Attributes:        series.attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Count:             series.count,
+			Sum:               &sum,
+			Scale:             series.scale,
+			ZeroCount:         series.zeroCount,
+			Positive:          denseBuckets(series.positive),
+			Negative:          denseBuckets(series.negative),
+		})
+	}
+	metric := h.series.metric()
+	metric.Data = &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		DataPoints:             points,
+	}}
+	return metric
+}
+
+type otlpSummary struct {
+	series *otlpSeriesSet
+	opts   SummaryOpts
+}
+
+func (s *otlpSummary) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	s.series.mu.Lock()
+	defer s.series.mu.Unlock()
+	series, _ := s.series.get(decodedKey)
+	// Unlike Prometheus' sliding window, quantiles start over every MaxAge
+	if series.stream == nil || time.Since(series.windowStart) > s.opts.MaxAge {
+		series.stream = quantile.NewTargeted(s.opts.objectives())
+		series.windowStart = time.Now()
+	}
+	val := s.series.desc.value(float64(intVal))
+	series.stream.Insert(val)
+	// The count and sum are cumulative, like those of Prometheus summaries
+	series.count++
+	series.value += val
+}
+
+func (s *otlpSummary) expire(before time.Time) {
+	s.series.expire(before)
+}
+
+func (s *otlpSummary) collect(start, now uint64) *metricspb.Metric {
+	s.series.mu.Lock()
+	defer s.series.mu.Unlock()
+	if len(s.series.series) == 0 {
+		return nil
+	}
+	points := make([]*metricspb.SummaryDataPoint, 0, len(s.series.series))
+	for _, series := range s.series.series {
+		quantiles := make([]*metricspb.SummaryDataPoint_ValueAtQuantile, 0, len(s.opts.Quantiles))
+		for _, q := range s.opts.Quantiles {
+			quantiles = append(quantiles, &metricspb.SummaryDataPoint_ValueAtQuantile{
+				Quantile: q,
+				Value:    series.stream.Query(q),
+			})
+		}
+		points = append(points, &metricspb.SummaryDataPoint{
+			Attributes:        series.attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Count:             series.count,
+			Sum:               series.value,
+			QuantileValues:    quantiles,
+		})
+	}
+	metric := s.series.metric()
+	metric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: points}}
+	return metric
+}
@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPMetricsProviderHTTP(t *testing.T) {
+	received := make(chan *colmetricspb.ExportMetricsServiceRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-tenant") != "bee" {
+			t.Errorf("expected headers to be sent, found %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("could not unmarshal export request: %v", err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	provider, err := NewOTLPMetricsProvider(ctx, &OTLPOpts{
+		Protocol:           "http/protobuf",
+		Endpoint:           collector.URL,
+		Headers:            map[string]string{"x-tenant": "bee"},
+		ExportInterval:     time.Hour,
+		ResourceAttributes: map[string]string{"k8s.cluster.name": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := provider.NewIncrementCounter("events", []string{"comm"}, UnitNone)
+	counter.Increment(ctx, map[string]string{"comm": "curl"})
+	counter.Increment(ctx, map[string]string{"comm": "curl"})
+	hist := provider.NewHistogram("latency", []string{}, []float64{10, 100}, UnitNone)
+	hist.Set(ctx, 50, map[string]string{})
+
+	// metrics are exported once more on shutdown, which waits for the export
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := provider.(Shutdowner).Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	var req *colmetricspb.ExportMetricsServiceRequest
+	select {
+	case req = <-received:
+	default:
+		t.Fatal("no export received once Shutdown returned")
+	}
+
+	rm := req.ResourceMetrics[0]
+	var foundCluster bool
+	for _, attr := range rm.Resource.Attributes {
+		if attr.Key == "k8s.cluster.name" && attr.Value.GetStringValue() == "test" {
+			foundCluster = true
+		}
+	}
+	if !foundCluster {
+		t.Errorf("expected resource attributes to be exported, found %v", rm.Resource.Attributes)
+	}
+
+	metrics := rm.ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, found %d", len(metrics))
+	}
+	sum := metrics[0].GetSum()
+	if metrics[0].Name != "ebpf_solo_io_events" || sum == nil || !sum.IsMonotonic {
+		t.Fatalf("expected a monotonic sum named ebpf_solo_io_events, found %v", metrics[0])
+	}
+	if v := sum.DataPoints[0].GetAsDouble(); v != 2 {
+		t.Errorf("expected counter value 2, found %v", v)
+	}
+	hp := metrics[1].GetHistogram().DataPoints[0]
+	if hp.Count != 1 || hp.BucketCounts[1] != 1 {
+		t.Errorf("expected a single observation in the second bucket, found %v", hp)
+	}
+}
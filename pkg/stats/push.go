@@ -0,0 +1,268 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/solo-io/go-utils/contextutils"
+)
+
+const (
+	// Push to an endpoint implementing Prometheus' remote_write protocol
+	PushRemoteWrite = "remote-write"
+	// Push to a Prometheus Pushgateway
+	PushPushgateway = "pushgateway"
+)
+
+type PrometheusPushOpts struct {
+	// Either PushRemoteWrite or PushPushgateway
+	Mode string
+	// remote_write endpoint, e.g. http://prometheus:9090/api/v1/write, or
+	// the base URL of the Pushgateway
+	URL string
+	// Sent with every push, e.g. for authentication
+	Headers map[string]string
+	// Job the metrics are pushed under, Pushgateway only
+	Job string
+	// How often metrics are pushed, they are also pushed once more on shutdown
+	Interval time.Duration
+	// Timeout of a single push
+	Timeout time.Duration
+}
+
+func (o *PrometheusPushOpts) initDefaults() {
+	if o.Job == "" {
+		o.Job = "bee"
+	}
+	if o.Interval == 0 {
+		o.Interval = 15 * time.Second
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+}
+
+// startPush pushes the metrics gathered from gatherer on an interval, and
+// once more when ctx is done or the returned pusher is shut down.
+func startPush(ctx context.Context, opts *PrometheusPushOpts, gatherer prometheus.Gatherer) (*pusher, error) {
+	opts.initDefaults()
+
+	client := &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &headerTransport{headers: opts.Headers, next: http.DefaultTransport},
+	}
+	p := &pusher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	switch opts.Mode {
+	case PushRemoteWrite:
+		p.push = func() error {
+			return remoteWrite(client, opts.URL, gatherer)
+		}
+	case PushPushgateway:
+		p.push = push.New(opts.URL, opts.Job).Gatherer(gatherer).Client(client).Push
+	default:
+		return nil, fmt.Errorf("unsupported push mode '%s', expected one of %s, %s", opts.Mode, PushRemoteWrite, PushPushgateway)
+	}
+
+	go p.run(ctx, opts.Interval)
+	return p, nil
+}
+
+type pusher struct {
+	// Pushes are bounded by the timeout of the http client
+	push func() error
+
+	stopOnce sync.Once
+	// Closed to push once more and stop
+	stop chan struct{}
+	// Closed once the last push is done
+	done chan struct{}
+}
+
+func (p *pusher) run(ctx context.Context, interval time.Duration) {
+	defer close(p.done)
+	logger := contextutils.LoggerFrom(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.push(); err != nil {
+				logger.Errorf("could not push Prometheus metrics: %v", err)
+			}
+			continue
+		case <-ctx.Done():
+		case <-p.stop:
+		}
+		if err := p.push(); err != nil {
+			logger.Errorf("could not push Prometheus metrics on shutdown: %v", err)
+		}
+		return
+	}
+}
+
+// shutdown pushes the metrics once more, unless that already happened as
+// the context of startPush is done, and waits for the push to complete
+func (p *pusher) shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("metrics were not pushed on shutdown: %w", ctx.Err())
+	}
+}
+
+// headerTransport sets headers on every request
+type headerTransport struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) > 0 {
+		req = req.Clone(req.Context())
+		for k, v := range t.headers {
+			req.Header.Set(k, v)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func remoteWrite(client *http.Client, url string, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, marshalWriteRequest(families, time.Now().UnixMilli()))
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("remote write to '%s' failed with status %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Field numbers of the remote_write protobuf messages, see prompb in the
+// Prometheus repository:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// marshalWriteRequest encodes the gathered metrics as a remote_write
+// WriteRequest, with every sample at timestamp (in milliseconds). Native
+// histograms are only sent with their classic buckets, count and sum.
+func marshalWriteRequest(families []*dto.MetricFamily, timestamp int64) []byte {
+	var buf []byte
+	labelPair := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: &name, Value: &value}
+	}
+	appendSeries := func(name string, labels []*dto.LabelPair, extra *dto.LabelPair, value float64) {
+		all := make([]*dto.LabelPair, 0, len(labels)+2)
+		all = append(all, labelPair("__name__", name))
+		all = append(all, labels...)
+		if extra != nil {
+			all = append(all, extra)
+		}
+		// Remote write receivers expect labels sorted by name
+		sort.Slice(all, func(i, j int) bool { return all[i].GetName() < all[j].GetName() })
+
+		var series []byte
+		for _, label := range all {
+			var l []byte
+			l = protowire.AppendTag(l, labelName, protowire.BytesType)
+			l = protowire.AppendString(l, label.GetName())
+			l = protowire.AppendTag(l, labelValue, protowire.BytesType)
+			l = protowire.AppendString(l, label.GetValue())
+			series = protowire.AppendTag(series, timeSeriesLabels, protowire.BytesType)
+			series = protowire.AppendBytes(series, l)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		series = protowire.AppendTag(series, timeSeriesSamples, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		buf = protowire.AppendTag(buf, writeRequestTimeseries, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, series)
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.Metric {
+			labels := metric.Label
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				appendSeries(name, labels, nil, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				appendSeries(name, labels, nil, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				appendSeries(name, labels, nil, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := metric.GetHistogram()
+				for _, bucket := range h.Bucket {
+					if math.IsInf(bucket.GetUpperBound(), 1) {
+						continue
+					}
+					le := strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)
+					appendSeries(name+"_bucket", labels, labelPair("le", le), float64(bucket.GetCumulativeCount()))
+				}
+				// The +Inf bucket is implicit in the gathered histogram
+				appendSeries(name+"_bucket", labels, labelPair("le", "+Inf"), float64(h.GetSampleCount()))
+				appendSeries(name+"_sum", labels, nil, h.GetSampleSum())
+				appendSeries(name+"_count", labels, nil, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := metric.GetSummary()
+				for _, quantile := range s.Quantile {
+					q := strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)
+					appendSeries(name, labels, labelPair("quantile", q), quantile.GetValue())
+				}
+				appendSeries(name+"_sum", labels, nil, s.GetSampleSum())
+				appendSeries(name+"_count", labels, nil, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return buf
+}
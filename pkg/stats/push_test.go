@@ -0,0 +1,164 @@
+package stats
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fields splits a protobuf message into its fields, keyed by field number
+func fields(t *testing.T, msg []byte) map[protowire.Number][][]byte {
+	found := map[protowire.Number][][]byte{}
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		msg = msg[n:]
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		value := msg[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		found[num] = append(found[num], value)
+		msg = msg[n:]
+	}
+	return found
+}
+
+func TestRemoteWrite(t *testing.T) {
+	// series by their labels, rendered as name{k=v,...}
+	received := make(chan map[string]float64, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("authorization") != "Bearer token" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("could not decompress body: %v", err)
+			return
+		}
+
+		series := map[string]float64{}
+		for _, ts := range fields(t, body)[writeRequestTimeseries] {
+			tsFields := fields(t, ts)
+			var name string
+			var labels []string
+			for _, label := range tsFields[timeSeriesLabels] {
+				l := fields(t, label)
+				if string(l[labelName][0]) == "__name__" {
+					name = string(l[labelValue][0])
+					continue
+				}
+				labels = append(labels, string(l[labelName][0])+"="+string(l[labelValue][0]))
+			}
+			sample := fields(t, tsFields[timeSeriesSamples][0])
+			value, _ := protowire.ConsumeFixed64(sample[sampleValue][0])
+			series[name+"{"+strings.Join(labels, ",")+"}"] = math.Float64frombits(value)
+		}
+		received <- series
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      prometheus.NewRegistry(),
+		Push: &PrometheusPushOpts{
+			Mode:     PushRemoteWrite,
+			URL:      receiver.URL,
+			Headers:  map[string]string{"authorization": "Bearer token"},
+			Interval: time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := provider.NewIncrementCounter("events", []string{"comm"}, UnitNone)
+	counter.Increment(ctx, map[string]string{"comm": "curl"})
+	provider.NewHistogram("latency", []string{}, []float64{10}, UnitNone).Set(ctx, 50, map[string]string{})
+
+	// metrics are pushed once more on shutdown, which waits for the push
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := provider.(Shutdowner).Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	var series map[string]float64
+	select {
+	case series = <-received:
+	default:
+		t.Fatal("no push received once Shutdown returned")
+	}
+
+	expected := map[string]float64{
+		"ebpf_solo_io_events{comm=curl}":       1,
+		"ebpf_solo_io_latency_bucket{le=10}":   0,
+		"ebpf_solo_io_latency_bucket{le=+Inf}": 1,
+		"ebpf_solo_io_latency_sum{}":           50,
+		"ebpf_solo_io_latency_count{}":         1,
+	}
+	for name, value := range expected {
+		if found, ok := series[name]; !ok || found != value {
+			t.Errorf("expected %s to be %v, found %v in %v", name, value, found, series)
+		}
+	}
+}
+
+func TestPushgateway(t *testing.T) {
+	received := make(chan string, 10)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Method + " " + r.URL.Path + " " + string(body)
+	}))
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      prometheus.NewRegistry(),
+		Push: &PrometheusPushOpts{
+			Mode:     PushPushgateway,
+			URL:      gateway.URL,
+			Job:      "ci",
+			Interval: time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.NewIncrementCounter("events", []string{}, UnitNone).Increment(ctx, map[string]string{})
+
+	// Shutdown pushes even if ctx is still running
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := provider.(Shutdowner).Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case push := <-received:
+		if !strings.HasPrefix(push, "PUT /metrics/job/ci ") || !strings.Contains(push, "ebpf_solo_io_events") {
+			t.Fatalf("unexpected push %q", push)
+		}
+	default:
+		t.Fatal("no push received once Shutdown returned")
+	}
+}
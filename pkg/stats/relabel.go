@@ -0,0 +1,396 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/hashstructure/v2"
+)
+
+const (
+	// Every label of a series over the series limit is set to this value,
+	// so together they make up a single overflow series
+	OverflowLabelValue = "__overflow__"
+
+	// Counts the series which went to the overflow series, per map
+	droppedSeriesMetricName = SelfMetricPrefix + "dropped_series"
+)
+
+// RelabelConfig changes the labels of the metric of a map before it is
+// exported, much like Prometheus' metric_relabel_configs. Rewrites are
+// applied first, then labels are dropped, then the series limit is enforced.
+type RelabelConfig struct {
+	// Labels which are removed, series which only differed by them are merged
+	DropLabels []string
+	// If set, only these labels are kept
+	KeepLabels []string
+	// Rewrites the values of labels, in order
+	Rewrites []RewriteRule
+	// Maximum number of series, 0 means unlimited. Any further series are
+	// merged into the overflow series.
+	SeriesLimit int
+}
+
+type RewriteRule struct {
+	Label string
+	// Must match the whole value, which is then replaced with Replacement.
+	// Values which don't match are left as they are.
+	Regex string
+	// May refer to capture groups of Regex, e.g. "$1"
+	Replacement string
+}
+
+// NewRelabelingMetricsProvider applies per map relabel rules, keyed by map
+// name, to the metrics of provider. Metrics without rules are left as they are.
+// Series which weren't updated within seriesTTL no longer count towards the
+// series limit, 0 counts them forever.
+func NewRelabelingMetricsProvider(
+	ctx context.Context,
+	provider MetricsProvider,
+	rules map[string]RelabelConfig,
+	seriesTTL time.Duration,
+) (MetricsProvider, error) {
+	compiled := make(map[string]*relabelRules, len(rules))
+	for name, cfg := range rules {
+		r := &relabelRules{config: cfg}
+		for _, rewrite := range cfg.Rewrites {
+			regex, err := regexp.Compile("^(?:" + rewrite.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("could not compile rewrite of label '%s' for '%s': %w", rewrite.Label, name, err)
+			}
+			r.rewrites = append(r.rewrites, compiledRewrite{
+				label:       rewrite.Label,
+				regex:       regex,
+				replacement: rewrite.Replacement,
+			})
+		}
+		compiled[name] = r
+	}
+
+	p := &relabelingMetricsProvider{
+		provider:      provider,
+		rules:         compiled,
+		droppedSeries: provider.NewIncrementCounter(droppedSeriesMetricName, []string{"map"}, UnitNone),
+	}
+	if resets, ok := provider.(resetCounter); ok {
+		p.counterResets = resets.resetsInstrument()
+	} else {
+		p.counterResets = provider.NewIncrementCounter(counterResetsMetricName, []string{"map"}, UnitNone)
+	}
+	if seriesTTL > 0 {
+		go expireSeries(ctx, seriesTTL, p.expirers.list)
+	}
+	return p, nil
+}
+
+type relabelRules struct {
+	config   RelabelConfig
+	rewrites []compiledRewrite
+}
+
+type compiledRewrite struct {
+	label       string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+type relabelingMetricsProvider struct {
+	provider      MetricsProvider
+	rules         map[string]*relabelRules
+	droppedSeries IncrementInstrument
+	counterResets IncrementInstrument
+	expirers      expirerList
+}
+
+func (p *relabelingMetricsProvider) Shutdown(ctx context.Context) error {
+	if s, ok := p.provider.(Shutdowner); ok {
+		return s.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (p *relabelingMetricsProvider) NewSetCounter(name string, labels []string, unit Unit) SetInstrument {
+	r, ok := p.relabeler(name, labels)
+	if !ok {
+		return p.provider.NewSetCounter(name, labels, unit)
+	}
+	c := &relabeledSetCounter{
+		relabeler:  r,
+		instrument: p.provider.NewSetCounter(name, r.labels, unit),
+		resets:     p.counterResets,
+		last:       map[uint64]*relabeledCount{},
+		totals:     map[uint64]uint64{},
+	}
+	p.expirers.add(c)
+	return c
+}
+
+func (p *relabelingMetricsProvider) NewIncrementCounter(name string, labels []string, unit Unit) IncrementInstrument {
+	r, ok := p.relabeler(name, labels)
+	if !ok {
+		return p.provider.NewIncrementCounter(name, labels, unit)
+	}
+	i := &relabeledIncrement{
+		relabeler:  r,
+		instrument: p.provider.NewIncrementCounter(name, r.labels, unit),
+	}
+	p.expirers.add(i)
+	return i
+}
+
+func (p *relabelingMetricsProvider) NewGauge(name string, labels []string, unit Unit) SetInstrument {
+	r, ok := p.relabeler(name, labels)
+	if !ok {
+		return p.provider.NewGauge(name, labels, unit)
+	}
+	// Gauges of merged series take the value which was set last
+	g := &relabeledSet{
+		relabeler:  r,
+		instrument: p.provider.NewGauge(name, r.labels, unit),
+	}
+	p.expirers.add(g)
+	return g
+}
+
+func (p *relabelingMetricsProvider) NewHistogram(name string, labels []string, buckets []float64, unit Unit) SetInstrument {
+	r, ok := p.relabeler(name, labels)
+	if !ok {
+		return p.provider.NewHistogram(name, labels, buckets, unit)
+	}
+	h := &relabeledSet{
+		relabeler:  r,
+		instrument: p.provider.NewHistogram(name, r.labels, buckets, unit),
+	}
+	p.expirers.add(h)
+	return h
+}
+
+func (p *relabelingMetricsProvider) NewNativeHistogram(name string, labels []string, opts NativeHistogramOpts, unit Unit) SetInstrument {
+	r, ok := p.relabeler(name, labels)
+	if !ok {
+		return p.provider.NewNativeHistogram(name, labels, opts, unit)
+	}
+	h := &relabeledSet{
+		relabeler:  r,
+		instrument: p.provider.NewNativeHistogram(name, r.labels, opts, unit),
+	}
+	p.expirers.add(h)
+	return h
+}
+
+func (p *relabelingMetricsProvider) NewSummary(name string, labels []string, opts SummaryOpts, unit Unit) SetInstrument {
+	r, ok := p.relabeler(name, labels)
+	if !ok {
+		return p.provider.NewSummary(name, labels, opts, unit)
+	}
+	s := &relabeledSet{
+		relabeler:  r,
+		instrument: p.provider.NewSummary(name, r.labels, opts, unit),
+	}
+	p.expirers.add(s)
+	return s
+}
+
+func (p *relabelingMetricsProvider) relabeler(name string, labels []string) (*relabeler, bool) {
+	rules, ok := p.rules[name]
+	if !ok {
+		return nil, false
+	}
+
+	drop := map[string]bool{}
+	for _, label := range rules.config.DropLabels {
+		drop[label] = true
+	}
+	keep := map[string]bool{}
+	for _, label := range rules.config.KeepLabels {
+		keep[label] = true
+	}
+	kept := []string{}
+	for _, label := range labels {
+		if drop[label] || (len(keep) > 0 && !keep[label]) {
+			continue
+		}
+		kept = append(kept, label)
+	}
+
+	return &relabeler{
+		name:          name,
+		rules:         rules,
+		labels:        kept,
+		series:        map[uint64]time.Time{},
+		overflowed:    map[uint64]time.Time{},
+		droppedSeries: p.droppedSeries,
+	}, true
+}
+
+// relabeler applies the relabel rules of a single metric
+type relabeler struct {
+	name  string
+	rules *relabelRules
+	// Labels of the metric after dropping labels
+	labels []string
+
+	droppedSeries IncrementInstrument
+
+	mu sync.Mutex
+	// When each series within the limit was last updated
+	series map[uint64]time.Time
+	// Series which went to the overflow series, so each is only counted once
+	overflowed map[uint64]time.Time
+}
+
+func (r *relabeler) relabel(ctx context.Context, labels map[string]string) map[string]string {
+	relabeled := make(map[string]string, len(r.labels))
+	for _, label := range r.labels {
+		value := labels[label]
+		for _, rewrite := range r.rules.rewrites {
+			if rewrite.label == label && rewrite.regex.MatchString(value) {
+				value = rewrite.regex.ReplaceAllString(value, rewrite.replacement)
+			}
+		}
+		relabeled[label] = value
+	}
+
+	limit := r.rules.config.SeriesLimit
+	if limit == 0 {
+		return relabeled
+	}
+
+	keyHash := hashLabels(relabeled)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.series[keyHash]; ok || len(r.series) < limit {
+		r.series[keyHash] = now
+		return relabeled
+	}
+
+	if _, ok := r.overflowed[keyHash]; !ok {
+		r.droppedSeries.Increment(ctx, map[string]string{"map": r.name})
+	}
+	r.overflowed[keyHash] = now
+	for label := range relabeled {
+		relabeled[label] = OverflowLabelValue
+	}
+	return relabeled
+}
+
+// expire frees the place of stale series within the series limit
+func (r *relabeler) expire(before time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for keyHash, updated := range r.series {
+		if updated.Before(before) {
+			delete(r.series, keyHash)
+		}
+	}
+	for keyHash, updated := range r.overflowed {
+		if updated.Before(before) {
+			delete(r.overflowed, keyHash)
+		}
+	}
+}
+
+func hashLabels(labels map[string]string) uint64 {
+	keyHash, err := hashstructure.Hash(labels, hashstructure.FormatV2, nil)
+	if err != nil {
+		log.Fatal("This should never happen")
+	}
+	return keyHash
+}
+
+type relabeledIncrement struct {
+	*relabeler
+	instrument IncrementInstrument
+}
+
+func (i *relabeledIncrement) Increment(ctx context.Context, labels map[string]string) {
+	i.instrument.Increment(ctx, i.relabel(ctx, labels))
+}
+
+func (i *relabeledIncrement) Add(ctx context.Context, val int64, labels map[string]string) {
+	i.instrument.Add(ctx, val, i.relabel(ctx, labels))
+}
+
+type relabeledSet struct {
+	*relabeler
+	instrument SetInstrument
+}
+
+func (s *relabeledSet) Set(ctx context.Context, val int64, labels map[string]string) {
+	s.instrument.Set(ctx, val, s.relabel(ctx, labels))
+}
+
+// relabeledSetCounter sums up the map entries which are merged into a single
+// series, as each of them holds a running total of its own
+type relabeledSetCounter struct {
+	*relabeler
+	instrument SetInstrument
+	resets     IncrementInstrument
+
+	countersMu sync.Mutex
+	// Last value of each map entry, keyed by its labels before relabeling
+	last map[uint64]*relabeledCount
+	// Running total of each series, keyed by its labels after relabeling
+	totals map[uint64]uint64
+}
+
+type relabeledCount struct {
+	value   uint64
+	updated time.Time
+	// The series the entry is merged into
+	seriesHash uint64
+}
+
+func (c *relabeledSetCounter) Set(ctx context.Context, val int64, labels map[string]string) {
+	entryHash := hashLabels(labels)
+	relabeled := c.relabel(ctx, labels)
+	seriesHash := hashLabels(relabeled)
+	now := time.Now()
+
+	c.countersMu.Lock()
+	last, ok := c.last[entryHash]
+	if !ok {
+		last = &relabeledCount{}
+		c.last[entryHash] = last
+	}
+	diff, reset := counterDelta(int64(last.value), val)
+	last.value, last.updated, last.seriesHash = uint64(val), now, seriesHash
+	c.totals[seriesHash] += diff
+	totalVal := c.totals[seriesHash]
+	c.countersMu.Unlock()
+
+	// The total never goes down, so the wrapped counter can't see resets
+	if reset {
+		c.resets.Increment(ctx, map[string]string{"map": c.name})
+	}
+	c.instrument.Set(ctx, int64(totalVal), relabeled)
+}
+
+// expire also forgets stale map entries, which are counted from scratch if
+// they come back. The total of a series is kept as long as any of its entries
+// is, as the wrapped counter still holds it: starting it over would look like
+// a reset to it, and count everything again. Once all of its entries are
+// stale, so is the series of the wrapped counter, and the total goes with it.
+func (c *relabeledSetCounter) expire(before time.Time) {
+	c.relabeler.expire(before)
+	c.countersMu.Lock()
+	defer c.countersMu.Unlock()
+	live := make(map[uint64]bool, len(c.totals))
+	for keyHash, count := range c.last {
+		if count.updated.Before(before) {
+			delete(c.last, keyHash)
+			continue
+		}
+		live[count.seriesHash] = true
+	}
+	for seriesHash := range c.totals {
+		if !live[seriesHash] {
+			delete(c.totals, seriesHash)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordedSample struct {
+	name   string
+	value  int64
+	labels map[string]string
+}
+
+// recordingProvider records every sample, in order
+type recordingProvider struct {
+	labels  map[string][]string
+	samples []recordedSample
+}
+
+type recordingInstrument struct {
+	provider *recordingProvider
+	name     string
+}
+
+func (r *recordingInstrument) Set(ctx context.Context, val int64, labels map[string]string) {
+	r.provider.samples = append(r.provider.samples, recordedSample{r.name, val, labels})
+}
+
+func (r *recordingInstrument) Increment(ctx context.Context, labels map[string]string) {
+	r.provider.samples = append(r.provider.samples, recordedSample{r.name, 1, labels})
+}
+
+func (r *recordingInstrument) Add(ctx context.Context, val int64, labels map[string]string) {
+	r.provider.samples = append(r.provider.samples, recordedSample{r.name, val, labels})
+}
+
+func (r *recordingProvider) instrument(name string, labels []string) *recordingInstrument {
+	r.labels[name] = labels
+	return &recordingInstrument{provider: r, name: name}
+}
+
+func (r *recordingProvider) NewSetCounter(name string, labels []string, unit Unit) SetInstrument {
+	return r.instrument(name, labels)
+}
+
+func (r *recordingProvider) NewIncrementCounter(name string, labels []string, unit Unit) IncrementInstrument {
+	return r.instrument(name, labels)
+}
+
+func (r *recordingProvider) NewGauge(name string, labels []string, unit Unit) SetInstrument {
+	return r.instrument(name, labels)
+}
+
+func (r *recordingProvider) NewHistogram(name string, labels []string, buckets []float64, unit Unit) SetInstrument {
+	return r.instrument(name, labels)
+}
+
+func (r *recordingProvider) NewNativeHistogram(name string, labels []string, opts NativeHistogramOpts, unit Unit) SetInstrument {
+	return r.instrument(name, labels)
+}
+
+func (r *recordingProvider) NewSummary(name string, labels []string, opts SummaryOpts, unit Unit) SetInstrument {
+	return r.instrument(name, labels)
+}
+
+func TestRelabelingMetricsProvider(t *testing.T) {
+	ctx := context.Background()
+	recorder := &recordingProvider{labels: map[string][]string{}}
+	provider, err := NewRelabelingMetricsProvider(ctx, recorder, map[string]RelabelConfig{
+		"events": {
+			DropLabels:  []string{"pid"},
+			Rewrites:    []RewriteRule{{Label: "daddr", Regex: `10\..*`, Replacement: "private"}},
+			SeriesLimit: 2,
+		},
+		"hash_events": {
+			KeepLabels: []string{"comm"},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := provider.NewIncrementCounter("events", []string{"pid", "daddr"}, UnitNone)
+	if labels := recorder.labels["events"]; !reflect.DeepEqual(labels, []string{"daddr"}) {
+		t.Fatalf("expected pid to be dropped, found labels %v", labels)
+	}
+	events.Increment(ctx, map[string]string{"pid": "1", "daddr": "10.0.0.1"})
+	events.Increment(ctx, map[string]string{"pid": "2", "daddr": "10.0.0.2"})
+	events.Increment(ctx, map[string]string{"pid": "3", "daddr": "1.1.1.1"})
+	events.Increment(ctx, map[string]string{"pid": "4", "daddr": "8.8.8.8"})
+	events.Increment(ctx, map[string]string{"pid": "5", "daddr": "8.8.8.8"})
+
+	hashEvents := provider.NewSetCounter("hash_events", []string{"pid", "comm"}, UnitNone)
+	hashEvents.Set(ctx, 5, map[string]string{"pid": "1", "comm": "curl"})
+	hashEvents.Set(ctx, 3, map[string]string{"pid": "2", "comm": "curl"})
+	hashEvents.Set(ctx, 7, map[string]string{"pid": "1", "comm": "curl"})
+
+	expected := []recordedSample{
+		{"events", 1, map[string]string{"daddr": "private"}},
+		{"events", 1, map[string]string{"daddr": "private"}},
+		{"events", 1, map[string]string{"daddr": "1.1.1.1"}},
+		// over the series limit
+		{droppedSeriesMetricName, 1, map[string]string{"map": "events"}},
+		{"events", 1, map[string]string{"daddr": OverflowLabelValue}},
+		// each dropped series is only counted once
+		{"events", 1, map[string]string{"daddr": OverflowLabelValue}},
+		// entries merged into one series add up
+		{"hash_events", 5, map[string]string{"comm": "curl"}},
+		{"hash_events", 8, map[string]string{"comm": "curl"}},
+		{"hash_events", 10, map[string]string{"comm": "curl"}},
+	}
+	if !reflect.DeepEqual(recorder.samples, expected) {
+		t.Fatalf("expected samples\n%v\nfound\n%v", expected, recorder.samples)
+	}
+}
+
+func TestRelabeledSetCounterExpiry(t *testing.T) {
+	ctx := context.Background()
+	recorder := &recordingProvider{labels: map[string][]string{}}
+	provider, err := NewRelabelingMetricsProvider(ctx, recorder, map[string]RelabelConfig{
+		"hash_events": {KeepLabels: []string{"comm"}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashEvents := provider.NewSetCounter("hash_events", []string{"pid", "comm"}, UnitNone)
+	counter := hashEvents.(*relabeledSetCounter)
+	first := map[string]string{"pid": "1", "comm": "curl"}
+	hashEvents.Set(ctx, 5, first)
+	hashEvents.Set(ctx, 3, map[string]string{"pid": "2", "comm": "curl"})
+
+	// the first entry was deleted from the map, and recreated after it expired
+	counter.last[hashLabels(first)].updated = time.Now().Add(-time.Hour)
+	counter.expire(time.Now().Add(-time.Minute))
+	hashEvents.Set(ctx, 2, first)
+
+	// the series keeps its total while the second entry is live, so the
+	// wrapped counter sees neither a reset nor the same events twice
+	expected := []recordedSample{
+		{"hash_events", 5, map[string]string{"comm": "curl"}},
+		{"hash_events", 8, map[string]string{"comm": "curl"}},
+		{"hash_events", 10, map[string]string{"comm": "curl"}},
+	}
+	if !reflect.DeepEqual(recorder.samples, expected) {
+		t.Fatalf("expected samples\n%v\nfound\n%v", expected, recorder.samples)
+	}
+
+	// once every entry of the series is stale, its total is forgotten too
+	counter.expire(time.Now().Add(time.Minute))
+	if len(counter.last) != 0 || len(counter.totals) != 0 {
+		t.Errorf("expected stale entries and totals to be forgotten, found %d entries and %d totals", len(counter.last), len(counter.totals))
+	}
+}
@@ -0,0 +1,185 @@
+package stats
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/solo-io/go-utils/contextutils"
+)
+
+// Health is the state of the loader, served on /healthz and /readyz. A nil
+// Health is always healthy and ready.
+type Health struct {
+	mu    sync.RWMutex
+	ready bool
+	err   error
+}
+
+// SetReady marks the programs as attached and their maps as watched
+func (h *Health) SetReady() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = true
+}
+
+// SetFailed marks the loader as stopped by err
+func (h *Health) SetFailed(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = false
+	h.err = err
+}
+
+func (h *Health) state() (ready bool, err error) {
+	if h == nil {
+		return true, nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ready, h.err
+}
+
+// healthz fails once the loader stopped with an error
+func (h *Health) healthz(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.state(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz only succeeds while the loader is watching the maps
+func (h *Health) readyz(w http.ResponseWriter, r *http.Request) {
+	ready, err := h.state()
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case !ready:
+		http.Error(w, "programs are not loaded yet", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serverHandler serves the metrics, health endpoints and, if enabled,
+// pprof. Only the metrics and pprof require basic auth, so that probes
+// don't need credentials.
+func serverHandler(opts *PrometheusOpts, metrics http.Handler) http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.Handle(opts.MetricsPath, withBasicAuth(opts, metrics))
+	serveMux.HandleFunc("/healthz", opts.Health.healthz)
+	serveMux.HandleFunc("/readyz", opts.Health.readyz)
+	if opts.EnablePprof {
+		serveMux.Handle("/debug/pprof/", withBasicAuth(opts, http.HandlerFunc(pprof.Index)))
+		serveMux.Handle("/debug/pprof/cmdline", withBasicAuth(opts, http.HandlerFunc(pprof.Cmdline)))
+		serveMux.Handle("/debug/pprof/profile", withBasicAuth(opts, http.HandlerFunc(pprof.Profile)))
+		serveMux.Handle("/debug/pprof/symbol", withBasicAuth(opts, http.HandlerFunc(pprof.Symbol)))
+		serveMux.Handle("/debug/pprof/trace", withBasicAuth(opts, http.HandlerFunc(pprof.Trace)))
+	}
+	return serveMux
+}
+
+func withBasicAuth(opts *PrometheusOpts, next http.Handler) http.Handler {
+	if opts.BasicAuthUsername == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		// Compare both, so that the time taken doesn't tell which one is wrong
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(opts.BasicAuthUsername))
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(opts.BasicAuthPassword))
+		if !ok || usernameMatch&passwordMatch != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bee"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func buildTLSConfig(opts *PrometheusOpts) (*tls.Config, error) {
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		if opts.ClientCAFile != "" {
+			return nil, errors.New("a client CA requires a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+		return nil, errors.New("both a TLS certificate and key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA '%s'", opts.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// startServer serves handler until ctx is done. If the address can't be
+// bound, this fails when opts.FailFast is set, and is only logged otherwise.
+func startServer(ctx context.Context, opts *PrometheusOpts, handler http.Handler) error {
+	logger := contextutils.LoggerFrom(ctx)
+	tlsConfig, err := buildTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	address := net.JoinHostPort(opts.ListenAddress, strconv.FormatUint(uint64(opts.Port), 10))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		if opts.FailFast {
+			return fmt.Errorf("could not listen for Prometheus metrics: %w", err)
+		}
+		logger.Errorf("could not listen for Prometheus metrics: %v", err)
+		return nil
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	server := &http.Server{
+		Handler: handler,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("could not serve Prometheus metrics: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestServerHandler(t *testing.T) {
+	health := &Health{}
+	opts := &PrometheusOpts{
+		MetricsPath:       "/metrics",
+		BasicAuthUsername: "prometheus",
+		BasicAuthPassword: "secret",
+		EnablePprof:       true,
+		Health:            health,
+	}
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := serverHandler(opts, metrics)
+
+	status := func(path string, auth bool) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth {
+			req.SetBasicAuth("prometheus", "secret")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	expect := func(path string, auth bool, expected int) {
+		t.Helper()
+		if found := status(path, auth); found != expected {
+			t.Errorf("expected %s (auth %v) to return %d, found %d", path, auth, expected, found)
+		}
+	}
+
+	expect("/metrics", false, http.StatusUnauthorized)
+	expect("/metrics", true, http.StatusOK)
+	expect("/debug/pprof/", false, http.StatusUnauthorized)
+	expect("/debug/pprof/", true, http.StatusOK)
+
+	// probes don't need credentials
+	expect("/healthz", false, http.StatusOK)
+	expect("/readyz", false, http.StatusServiceUnavailable)
+	health.SetReady()
+	expect("/readyz", false, http.StatusOK)
+	health.SetFailed(errors.New("could not attach kprobe"))
+	expect("/healthz", false, http.StatusServiceUnavailable)
+	expect("/readyz", false, http.StatusServiceUnavailable)
+}
+
+// takenPort returns a port of 127.0.0.1 which is held until the test ends, so
+// the metrics server of a test can't listen on it, even when run as root
+func takenPort(t *testing.T) uint32 {
+	t.Helper()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { taken.Close() })
+	return uint32(taken.Addr().(*net.TCPAddr).Port)
+}
+
+func TestFailFast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      prometheus.NewRegistry(),
+		FailFast:      true,
+	})
+	if err == nil {
+		t.Fatal("expected an error as the port is taken")
+	}
+}
@@ -2,25 +2,52 @@ package stats
 
 import (
 	"context"
-	"fmt"
 	"log"
-	"net/http"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/hashstructure/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-
-	"github.com/solo-io/go-utils/contextutils"
 )
 
 const (
 	ebpfNamespace = "ebpf_solo_io"
+
+	// Metrics of bee itself are prefixed with this. Maps need one of the
+	// prefixes of their metric type, e.g. counter_, so no map is named like them.
+	SelfMetricPrefix = "bee_"
+
+	// Counts how often the entries behind a set counter started over, per map
+	counterResetsMetricName = SelfMetricPrefix + "counter_resets"
 )
 
 type PrometheusOpts struct {
-	Port        uint32
-	MetricsPath string
-	Registry    *prometheus.Registry
+	// Address the server binds, all interfaces if empty
+	ListenAddress string
+	Port          uint32
+	MetricsPath   string
+	// Serve over TLS if both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// If set, clients must present a certificate signed by this CA
+	ClientCAFile string
+	// If set, the metrics and pprof require basic auth
+	BasicAuthUsername string
+	BasicAuthPassword string
+	// Serve /debug/pprof
+	EnablePprof bool
+	// Fail instead of only logging if the server can't listen
+	FailFast bool
+	// State of the loader, served on /healthz and /readyz
+	Health   *Health
+	Registry *prometheus.Registry
+	Naming   NamingOpts
+	// Series which weren't updated for this long are removed, 0 keeps them forever
+	SeriesTTL time.Duration
+	// If set, metrics are also pushed, for runs which are too short to be scraped
+	Push *PrometheusPushOpts
 }
 
 func (p *PrometheusOpts) initDefaults() {
@@ -30,108 +57,229 @@ func (p *PrometheusOpts) initDefaults() {
 	if p.MetricsPath == "" {
 		p.MetricsPath = "/metrics"
 	}
+	p.Naming.initDefaults()
 }
 
 func NewPrometheusMetricsProvider(ctx context.Context, opts *PrometheusOpts) (MetricsProvider, error) {
 	opts.initDefaults()
 
-	serveMux := http.NewServeMux()
 	handler := promhttp.Handler()
 	if opts.Registry != nil {
 		handler = promhttp.InstrumentMetricHandler(opts.Registry, promhttp.HandlerFor(opts.Registry, promhttp.HandlerOpts{}))
 	}
-	serveMux.Handle(opts.MetricsPath, handler)
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", opts.Port),
-		Handler: serveMux,
+	if err := startServer(ctx, opts, serverHandler(opts, handler)); err != nil {
+		return nil, err
 	}
-	go func() {
-		err := server.ListenAndServe()
-		if err != nil {
-			contextutils.LoggerFrom(ctx).Errorf("could not listen for Prometheus metrics: %v", err)
-		}
-	}()
 
-	go func() {
-		<-ctx.Done()
-		server.Close()
-	}()
+	var metricsPusher *pusher
+	if opts.Push != nil {
+		var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+		if opts.Registry != nil {
+			gatherer = opts.Registry
+		}
+		var err error
+		if metricsPusher, err = startPush(ctx, opts.Push, gatherer); err != nil {
+			return nil, err
+		}
+	}
 
-	return &metricsProvider{
-		registry: opts.Registry,
-	}, nil
+	m := &metricsProvider{
+		registry:  opts.Registry,
+		naming:    opts.Naming,
+		seriesTTL: opts.SeriesTTL,
+		pusher:    metricsPusher,
+	}
+	m.counterResets = m.NewIncrementCounter(counterResetsMetricName, []string{"map"}, UnitNone)
+	if opts.SeriesTTL > 0 {
+		go expireSeries(ctx, opts.SeriesTTL, m.expirers.list)
+	}
+	return m, nil
 }
 
+// MetricsProvider creates the instruments of metrics. The unit of an
+// instrument is that of the raw values it is handed, buckets are in the
+// unit values are exported in, e.g. seconds for UnitNanoseconds.
 type MetricsProvider interface {
-	NewSetCounter(name string, labels []string) SetInstrument
-	NewIncrementCounter(name string, labels []string) IncrementInstrument
-	NewGauge(name string, labels []string) SetInstrument
-	NewHistogram(name string, labels []string, buckets []float64) SetInstrument
+	NewSetCounter(name string, labels []string, unit Unit) SetInstrument
+	NewIncrementCounter(name string, labels []string, unit Unit) IncrementInstrument
+	NewGauge(name string, labels []string, unit Unit) SetInstrument
+	NewHistogram(name string, labels []string, buckets []float64, unit Unit) SetInstrument
+	// NewNativeHistogram observes into exponentially growing buckets, instead of fixed ones
+	NewNativeHistogram(name string, labels []string, opts NativeHistogramOpts, unit Unit) SetInstrument
+	// NewSummary observes values and exports quantiles of them
+	NewSummary(name string, labels []string, opts SummaryOpts, unit Unit) SetInstrument
+}
+
+// Shutdowner is implemented by the providers which send metrics on their
+// own. Shutdown sends what was collected since the last send, and waits for
+// that to complete until ctx is done.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
 }
 
 type IncrementInstrument interface {
 	Increment(ctx context.Context, labels map[string]string)
+	// Add increments by val instead of 1
+	Add(ctx context.Context, val int64, labels map[string]string)
 }
 
 type SetInstrument interface {
 	Set(ctx context.Context, val int64, labels map[string]string)
 }
 
+// resetCounter is implemented by the providers of this package, so that
+// wrapping providers count set counter resets in the same metric
+type resetCounter interface {
+	resetsInstrument() IncrementInstrument
+}
+
 type metricsProvider struct {
-	registry *prometheus.Registry
+	registry      *prometheus.Registry
+	naming        NamingOpts
+	counterResets IncrementInstrument
+
+	seriesTTL time.Duration
+	expirers  expirerList
+
+	// Set if metrics are pushed as well
+	pusher *pusher
 }
 
-func (m *metricsProvider) NewSetCounter(name string, labels []string) SetInstrument {
-	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: ebpfNamespace,
-		Name:      name,
-	}, labels)
+func (m *metricsProvider) Shutdown(ctx context.Context) error {
+	if m.pusher == nil {
+		return nil
+	}
+	return m.pusher.shutdown(ctx)
+}
+
+func (m *metricsProvider) NewSetCounter(name string, labels []string, unit Unit) SetInstrument {
+	opts, desc := m.opts(name, labels, unit)
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts(opts), labels)
 
 	m.register(counter)
-	return &setCounter{
+	c := &setCounter{
+		name:       name,
+		desc:       desc,
 		counter:    counter,
 		counterMap: map[uint64]int64{},
+		resets:     m.counterResets,
+		tracker:    newSeriesTracker(m.seriesTTL),
 	}
+	m.expirers.add(c)
+	return c
 }
 
-func (m *metricsProvider) NewIncrementCounter(name string, labels []string) IncrementInstrument {
-	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: ebpfNamespace,
-		Name:      name,
-	}, labels)
+func (m *metricsProvider) NewIncrementCounter(name string, labels []string, unit Unit) IncrementInstrument {
+	opts, desc := m.opts(name, labels, unit)
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts(opts), labels)
 
 	m.register(counter)
 	return &incrementCounter{
+		desc:    desc,
 		counter: counter,
+		series:  m.vecSeries(counter),
 	}
 }
 
-func (m *metricsProvider) NewGauge(name string, labels []string) SetInstrument {
-	gaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: ebpfNamespace,
-		Name:      name,
-	}, labels)
+func (m *metricsProvider) NewGauge(name string, labels []string, unit Unit) SetInstrument {
+	opts, desc := m.opts(name, labels, unit)
+	gaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts(opts), labels)
 
 	m.register(gaugeVec)
 	return &gauge{
-		gauge: gaugeVec,
+		desc:   desc,
+		gauge:  gaugeVec,
+		series: m.vecSeries(gaugeVec),
 	}
 }
 
-func (m *metricsProvider) NewHistogram(name string, labels []string, buckets []float64) SetInstrument {
+func (m *metricsProvider) NewHistogram(name string, labels []string, buckets []float64, unit Unit) SetInstrument {
+	opts, desc := m.opts(name, labels, unit)
 	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: ebpfNamespace,
-		Name:      name,
-		Buckets:   buckets,
+		Namespace:   opts.Namespace,
+		Name:        opts.Name,
+		Help:        opts.Help,
+		ConstLabels: opts.ConstLabels,
+		Buckets:     buckets,
 	}, labels)
 
 	m.register(h)
 	return &histogram{
+		desc:      desc,
 		histogram: h,
+		series:    m.vecSeries(h),
 	}
 
 }
 
+func (m *metricsProvider) NewNativeHistogram(name string, labels []string, nativeOpts NativeHistogramOpts, unit Unit) SetInstrument {
+	nativeOpts.initDefaults()
+	opts, desc := m.opts(name, labels, unit)
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        opts.Name,
+		Help:        opts.Help,
+		ConstLabels: opts.ConstLabels,
+		// Native histograms are only served in the protobuf exposition format,
+		// scrapers using the text format only see the classic buckets
+		Buckets:                        nativeOpts.ClassicBuckets,
+		NativeHistogramBucketFactor:    nativeOpts.BucketFactor,
+		NativeHistogramMaxBucketNumber: nativeOpts.MaxBuckets,
+	}, labels)
+
+	m.register(h)
+	return &histogram{
+		desc:      desc,
+		histogram: h,
+		series:    m.vecSeries(h),
+	}
+}
+
+func (m *metricsProvider) NewSummary(name string, labels []string, summaryOpts SummaryOpts, unit Unit) SetInstrument {
+	summaryOpts.initDefaults()
+	opts, desc := m.opts(name, labels, unit)
+	s := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:   opts.Namespace,
+		Name:        opts.Name,
+		Help:        opts.Help,
+		ConstLabels: opts.ConstLabels,
+		Objectives:  summaryOpts.objectives(),
+		MaxAge:      summaryOpts.MaxAge,
+	}, labels)
+
+	m.register(s)
+	return &summary{
+		desc:    desc,
+		summary: s,
+		series:  m.vecSeries(s),
+	}
+}
+
+// vecSeries tracks the series of vec, removing them once they are stale
+func (m *metricsProvider) vecSeries(vec deleter) *vecSeries {
+	v := &vecSeries{
+		tracker: newSeriesTracker(m.seriesTTL),
+		vec:     vec,
+	}
+	m.expirers.add(v)
+	return v
+}
+
+func (m *metricsProvider) resetsInstrument() IncrementInstrument {
+	return m.counterResets
+}
+
+// opts names and describes a metric, counter and gauge options share this type
+func (m *metricsProvider) opts(name string, labels []string, unit Unit) (prometheus.Opts, metricDesc) {
+	desc := m.naming.describe(name, labels, unit)
+	return prometheus.Opts{
+		Namespace:   m.naming.Namespace,
+		Name:        desc.name,
+		Help:        desc.help,
+		ConstLabels: desc.constLabels,
+	}, desc
+}
+
 func (m *metricsProvider) register(collectors ...prometheus.Collector) {
 	if m.registry != nil {
 		m.registry.MustRegister(collectors...)
@@ -140,8 +288,31 @@ func (m *metricsProvider) register(collectors ...prometheus.Collector) {
 	prometheus.MustRegister(collectors...)
 }
 
+// deleter is implemented by every *Vec
+type deleter interface {
+	Delete(labels prometheus.Labels) bool
+}
+
+// vecSeries removes the stale series of a *Vec
+type vecSeries struct {
+	tracker *seriesTracker
+	vec     deleter
+}
+
+func (v *vecSeries) expire(before time.Time) {
+	for _, series := range v.tracker.expire(before) {
+		v.vec.Delete(prometheus.Labels(series.labels))
+	}
+}
+
 type setCounter struct {
-	counter    *prometheus.CounterVec
+	name    string
+	desc    metricDesc
+	counter *prometheus.CounterVec
+	resets  IncrementInstrument
+	tracker *seriesTracker
+
+	mu         sync.Mutex
 	counterMap map[uint64]int64
 }
 
@@ -156,28 +327,78 @@ func (c *setCounter) Set(
 		log.Fatal("This should never happen")
 	}
 
+	// Unchanged map entries are still live
+	c.tracker.touchHash(keyHash, decodedKey)
+
+	c.mu.Lock()
 	oldVal := c.counterMap[keyHash]
-	diff := intVal - oldVal
+	c.counterMap[keyHash] = intVal
+	c.mu.Unlock()
 	if oldVal == intVal {
 		return
 	}
-	c.counterMap[keyHash] = intVal
-	c.counter.With(prometheus.Labels(decodedKey)).Add(float64(diff))
+	diff, reset := counterDelta(oldVal, intVal)
+	if reset {
+		c.resets.Increment(ctx, map[string]string{"map": c.name})
+	}
+	c.counter.With(prometheus.Labels(decodedKey)).Add(c.desc.value(float64(diff)))
+}
+
+// counterDelta returns how much a counter read from a kernel map grew since
+// the last time it was read. Counters are u64s carried in an int64.
+// A counter which went down was either reset, e.g. the map entry was deleted
+// and recreated, in which case everything in it is new, or wrapped around.
+func counterDelta(oldVal, intVal int64) (diff uint64, reset bool) {
+	oldCount, newCount := uint64(oldVal), uint64(intVal)
+	if newCount >= oldCount {
+		return newCount - oldCount, false
+	}
+	// A counter only gets close to the end of the u64 range by wrapping around,
+	// in which case the unsigned difference is exact
+	if oldCount > math.MaxUint64/2 && newCount <= math.MaxUint64/2 {
+		return newCount - oldCount, false
+	}
+	return newCount, true
+}
+
+// expire also forgets the last value of stale map entries, an entry which
+// comes back is counted from scratch like its series
+func (c *setCounter) expire(before time.Time) {
+	for _, series := range c.tracker.expire(before) {
+		c.counter.Delete(prometheus.Labels(series.labels))
+		c.mu.Lock()
+		delete(c.counterMap, series.hash)
+		c.mu.Unlock()
+	}
 }
 
 type incrementCounter struct {
+	desc    metricDesc
 	counter *prometheus.CounterVec
+	series  *vecSeries
 }
 
 func (i *incrementCounter) Increment(
 	ctx context.Context,
 	decodedKey map[string]string,
 ) {
+	i.series.tracker.touch(decodedKey)
 	i.counter.With(prometheus.Labels(decodedKey)).Inc()
 }
 
+func (i *incrementCounter) Add(
+	ctx context.Context,
+	val int64,
+	decodedKey map[string]string,
+) {
+	i.series.tracker.touch(decodedKey)
+	i.counter.With(prometheus.Labels(decodedKey)).Add(i.desc.value(float64(val)))
+}
+
 type gauge struct {
-	gauge *prometheus.GaugeVec
+	desc   metricDesc
+	gauge  *prometheus.GaugeVec
+	series *vecSeries
 }
 
 func (g *gauge) Set(
@@ -185,11 +406,14 @@ func (g *gauge) Set(
 	intVal int64,
 	decodedKey map[string]string,
 ) {
-	g.gauge.With(prometheus.Labels(decodedKey)).Set(float64(intVal))
+	g.series.tracker.touch(decodedKey)
+	g.gauge.With(prometheus.Labels(decodedKey)).Set(g.desc.value(float64(intVal)))
 }
 
 type histogram struct {
+	desc      metricDesc
 	histogram *prometheus.HistogramVec
+	series    *vecSeries
 }
 
 func (h *histogram) Set(
@@ -197,5 +421,21 @@ func (h *histogram) Set(
 	intVal int64,
 	decodedKey map[string]string,
 ) {
-	h.histogram.With(prometheus.Labels(decodedKey)).Observe(float64(intVal))
+	h.series.tracker.touch(decodedKey)
+	h.histogram.With(prometheus.Labels(decodedKey)).Observe(h.desc.value(float64(intVal)))
+}
+
+type summary struct {
+	desc    metricDesc
+	summary *prometheus.SummaryVec
+	series  *vecSeries
+}
+
+func (s *summary) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	s.series.tracker.touch(decodedKey)
+	s.summary.With(prometheus.Labels(decodedKey)).Observe(s.desc.value(float64(intVal)))
 }
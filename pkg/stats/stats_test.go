@@ -0,0 +1,267 @@
+package stats
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCounterDelta(t *testing.T) {
+	maxCount := uint64(math.MaxUint64)
+	cases := []struct {
+		name   string
+		oldVal uint64
+		newVal uint64
+		diff   uint64
+		reset  bool
+	}{
+		{name: "growth", oldVal: 10, newVal: 25, diff: 15},
+		{name: "reset", oldVal: 25, newVal: 4, diff: 4, reset: true},
+		{name: "wraparound", oldVal: maxCount - 2, newVal: 5, diff: 8},
+		{name: "beyond int64", oldVal: math.MaxInt64, newVal: math.MaxInt64 + 10, diff: 10},
+	}
+	for _, tc := range cases {
+		diff, reset := counterDelta(int64(tc.oldVal), int64(tc.newVal))
+		if diff != tc.diff || reset != tc.reset {
+			t.Errorf("%s: expected (%d, %v), found (%d, %v)", tc.name, tc.diff, tc.reset, diff, reset)
+		}
+	}
+}
+
+func TestSetCounterReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{ListenAddress: "127.0.0.1", Port: takenPort(t), Registry: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"pid": "1234"}
+	counter := provider.NewSetCounter("events", []string{"pid"}, UnitNone)
+	counter.Set(ctx, 10, labels)
+	// the map entry was deleted and recreated
+	counter.Set(ctx, 3, labels)
+
+	setCounter := counter.(*setCounter)
+	if v := testutil.ToFloat64(setCounter.counter.With(labels)); v != 13 {
+		t.Errorf("expected the counter to keep counting after a reset, found %v", v)
+	}
+	resets := provider.(*metricsProvider).counterResets.(*incrementCounter)
+	if v := testutil.ToFloat64(resets.counter.With(prometheus.Labels{"map": "events"})); v != 1 {
+		t.Errorf("expected 1 reset, found %v", v)
+	}
+}
+
+func TestSelfMetricsDontClashWithMaps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{ListenAddress: "127.0.0.1", Port: takenPort(t), Registry: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabeling, err := NewRelabelingMetricsProvider(ctx, provider, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// registering a metric under the name of a self-metric would panic
+	for _, name := range []string{"counter_resets", "dropped_series"} {
+		relabeling.NewSetCounter(name, []string{"pid"}, UnitNone).Set(ctx, 1, map[string]string{"pid": "1"})
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrometheusNaming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      registry,
+		Naming: NamingOpts{
+			Namespace:   "bee",
+			ConstLabels: map[string]string{"cluster": "prod", "comm": "overridden"},
+			Metrics: map[string]MetricOpts{
+				"hist_latency": {Name: "open_latency", Help: "Latency of open calls", Unit: "seconds"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.NewHistogram("hist_latency", []string{"comm"}, []float64{1}, UnitNone).Set(ctx, 1, map[string]string{"comm": "curl"})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, family := range families {
+		if family.GetName() != "bee_open_latency_seconds" {
+			continue
+		}
+		found = true
+		if family.GetHelp() != "Latency of open calls" {
+			t.Errorf("expected help to be set, found %q", family.GetHelp())
+		}
+		labels := map[string]string{}
+		for _, label := range family.Metric[0].Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["cluster"] != "prod" || labels["comm"] != "curl" {
+			t.Errorf("expected const labels without clashing with the map labels, found %v", labels)
+		}
+	}
+	if !found {
+		t.Fatalf("expected metric bee_open_latency_seconds, found %v", families)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raw durations are nanoseconds, observed in seconds
+	provider.NewHistogram("hist_latency", []string{}, []float64{0.001, 0.01}, UnitNanoseconds).Set(ctx, 1500000, map[string]string{})
+	queue := provider.NewGauge("gauge_queue", []string{}, UnitBytes)
+	queue.Set(ctx, 4096, map[string]string{})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, family := range families {
+		found[family.GetName()] = true
+		if family.GetName() == "ebpf_solo_io_hist_latency_seconds" {
+			h := family.Metric[0].GetHistogram()
+			if h.GetSampleSum() != 0.0015 || h.Bucket[0].GetCumulativeCount() != 0 || h.Bucket[1].GetCumulativeCount() != 1 {
+				t.Errorf("expected 1.5ms to be observed in seconds, found %v", h)
+			}
+		}
+	}
+	if !found["ebpf_solo_io_hist_latency_seconds"] || !found["ebpf_solo_io_gauge_queue_bytes"] {
+		t.Fatalf("expected metrics named after their units, found %v", found)
+	}
+	if v := testutil.ToFloat64(queue.(*gauge).gauge); v != 4096 {
+		t.Errorf("expected bytes to be exported as they are, found %v", v)
+	}
+}
+
+func TestNativeHistogramAndSummary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	native := provider.NewNativeHistogram("hist_latency", []string{}, NativeHistogramOpts{}, UnitNanoseconds)
+	summary := provider.NewSummary("hist_size", []string{}, SummaryOpts{Quantiles: []float64{0.5}}, UnitNone)
+	for i := int64(1); i <= 100; i++ {
+		native.Set(ctx, i*1000, map[string]string{})
+		summary.Set(ctx, i, map[string]string{})
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, family := range families {
+		found[family.GetName()] = true
+		switch family.GetName() {
+		case "ebpf_solo_io_hist_latency_seconds":
+			h := family.Metric[0].GetHistogram()
+			// a bucket factor of 1.1 is schema 3, buckets growing by 2^(1/8)
+			if h.GetSchema() != 3 || h.GetSampleCount() != 100 || len(h.Bucket) != 0 || len(h.PositiveSpan) == 0 {
+				t.Errorf("expected a native histogram without classic buckets, found %v", h)
+			}
+		case "ebpf_solo_io_hist_size":
+			s := family.Metric[0].GetSummary()
+			if len(s.Quantile) != 1 || s.Quantile[0].GetQuantile() != 0.5 || s.Quantile[0].GetValue() < 45 || s.Quantile[0].GetValue() > 55 {
+				t.Errorf("expected the median of 1 to 100, found %v", s.Quantile)
+			}
+		}
+	}
+	if !found["ebpf_solo_io_hist_latency_seconds"] || !found["ebpf_solo_io_hist_size"] {
+		t.Fatalf("expected both metrics, found %v", found)
+	}
+}
+
+func TestSeriesTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	provider, err := NewPrometheusMetricsProvider(ctx, &PrometheusOpts{
+		ListenAddress: "127.0.0.1",
+		Port:          takenPort(t),
+		Registry:      registry,
+		SeriesTTL:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sockets := provider.NewGauge("sockets", []string{"daddr"}, UnitNone)
+	sockets.Set(ctx, 1, map[string]string{"daddr": "1.1.1.1"})
+	stale := time.Now().Add(time.Second)
+	for time.Now().Before(stale) {
+		sockets.Set(ctx, 2, map[string]string{"daddr": "8.8.8.8"})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	vec := sockets.(*gauge).gauge
+	if n := testutil.CollectAndCount(vec); n != 1 {
+		t.Fatalf("expected only the updated series to be left, found %d series", n)
+	}
+	if v := testutil.ToFloat64(vec.With(prometheus.Labels{"daddr": "8.8.8.8"})); v != 2 {
+		t.Errorf("expected the updated series to be kept, found %v", v)
+	}
+}
+
+func TestNamingOptsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		naming NamingOpts
+		valid  bool
+	}{
+		{naming: NamingOpts{Namespace: "bee", ConstLabels: map[string]string{"cluster": "prod"}, Metrics: map[string]MetricOpts{"hist": {Name: "latency", Unit: "seconds"}}}, valid: true},
+		{naming: NamingOpts{Namespace: "bee-prod"}},
+		{naming: NamingOpts{ConstLabels: map[string]string{"k8s.node": "a"}}},
+		{naming: NamingOpts{ConstLabels: map[string]string{"__name__": "a"}}},
+		{naming: NamingOpts{Metrics: map[string]MetricOpts{"hist": {Name: "2xx"}}}},
+		{naming: NamingOpts{Metrics: map[string]MetricOpts{"hist": {Unit: "µs"}}}},
+	} {
+		err := tc.naming.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("expected %+v to be valid, found %v", tc.naming, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected %+v to be invalid", tc.naming)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/hashstructure/v2"
+	"go.uber.org/zap"
+
+	"github.com/solo-io/go-utils/contextutils"
+)
+
+type StatsdOpts struct {
+	// host:port of the statsd agent
+	Address string
+	// Prepended to the name of every metric
+	Prefix string
+	// Send labels as DogStatsD tags. Plain StatsD has no tags, so labels are
+	// appended to the metric name instead.
+	DogStatsD bool
+	// Metrics are batched into packets of up to this many bytes
+	MaxPacketSize int
+	// How often a partially filled packet is sent
+	FlushInterval time.Duration
+	Naming        NamingOpts
+	// The agent holds the series, but set counters remember the last value of
+	// each map entry. Entries which weren't updated for this long are
+	// forgotten, 0 keeps them forever.
+	SeriesTTL time.Duration
+}
+
+func (o *StatsdOpts) initDefaults() {
+	if o.Address == "" {
+		o.Address = "localhost:8125"
+	}
+	o.Naming.initDefaults()
+	if o.Prefix == "" {
+		o.Prefix = o.Naming.Namespace + "."
+	}
+	if o.MaxPacketSize == 0 {
+		// Fits in a single ethernet frame
+		o.MaxPacketSize = 1432
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = time.Second
+	}
+}
+
+// NewStatsdMetricsProvider returns a MetricsProvider which sends every update
+// to a StatsD or DogStatsD agent over UDP, leaving aggregation to the agent.
+func NewStatsdMetricsProvider(ctx context.Context, opts *StatsdOpts) (MetricsProvider, error) {
+	opts.initDefaults()
+
+	conn, err := net.Dial("udp", opts.Address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to statsd agent '%s': %w", opts.Address, err)
+	}
+
+	s := &statsdMetricsProvider{
+		logger: contextutils.LoggerFrom(ctx),
+		opts:   *opts,
+		conn:   conn,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.counterResets = s.NewIncrementCounter(counterResetsMetricName, []string{"map"}, UnitNone)
+	if opts.SeriesTTL > 0 {
+		go expireSeries(ctx, opts.SeriesTTL, s.expirers.list)
+	}
+
+	go s.flushEvery(ctx, opts.FlushInterval)
+
+	return s, nil
+}
+
+type statsdMetricsProvider struct {
+	logger *zap.SugaredLogger
+	opts   StatsdOpts
+	conn   net.Conn
+
+	counterResets IncrementInstrument
+	expirers      expirerList
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+
+	stopOnce sync.Once
+	// Closed to flush once more and stop
+	stop chan struct{}
+	// Closed once the last flush is done
+	done chan struct{}
+}
+
+// flushEvery sends the partially filled packet on an interval, and once more
+// when ctx is done or the provider is shut down
+func (s *statsdMetricsProvider) flushEvery(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				s.logger.Errorf("could not send statsd metrics: %v", err)
+			}
+			continue
+		case <-ctx.Done():
+		case <-s.stop:
+		}
+		if err := s.flush(); err != nil {
+			s.logger.Errorf("could not send statsd metrics on shutdown: %v", err)
+		}
+		s.conn.Close()
+		return
+	}
+}
+
+// Shutdown sends the metrics which weren't sent yet, unless that already
+// happened as the context of the provider is done, and waits for the send
+func (s *statsdMetricsProvider) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("statsd metrics were not sent on shutdown: %w", ctx.Err())
+	}
+}
+
+func (s *statsdMetricsProvider) NewSetCounter(name string, labels []string, unit Unit) SetInstrument {
+	c := &statsdSetCounter{
+		provider:   s,
+		name:       name,
+		desc:       s.opts.Naming.describe(name, labels, unit),
+		counterMap: map[uint64]int64{},
+		resets:     s.counterResets,
+		tracker:    newSeriesTracker(s.opts.SeriesTTL),
+	}
+	s.expirers.add(c)
+	return c
+}
+
+func (s *statsdMetricsProvider) NewIncrementCounter(name string, labels []string, unit Unit) IncrementInstrument {
+	return &statsdIncrementCounter{
+		provider: s,
+		desc:     s.opts.Naming.describe(name, labels, unit),
+	}
+}
+
+func (s *statsdMetricsProvider) NewGauge(name string, labels []string, unit Unit) SetInstrument {
+	return &statsdGauge{
+		provider: s,
+		desc:     s.opts.Naming.describe(name, labels, unit),
+	}
+}
+
+func (s *statsdMetricsProvider) NewHistogram(name string, labels []string, buckets []float64, unit Unit) SetInstrument {
+	// The agent computes the distribution, so buckets don't apply
+	return s.newDistribution(name, labels, unit)
+}
+
+func (s *statsdMetricsProvider) NewNativeHistogram(name string, labels []string, opts NativeHistogramOpts, unit Unit) SetInstrument {
+	return s.newDistribution(name, labels, unit)
+}
+
+func (s *statsdMetricsProvider) NewSummary(name string, labels []string, opts SummaryOpts, unit Unit) SetInstrument {
+	// Which percentiles are computed is configured on the agent
+	return s.newDistribution(name, labels, unit)
+}
+
+func (s *statsdMetricsProvider) newDistribution(name string, labels []string, unit Unit) SetInstrument {
+	h := &statsdHistogram{
+		provider:   s,
+		desc:       s.opts.Naming.describe(name, labels, unit),
+		metricType: "h",
+	}
+	if !s.opts.DogStatsD {
+		h.metricType = "ms"
+		if unit == UnitNanoseconds {
+			// Timers are in milliseconds, so the name doesn't get the
+			// _seconds suffix, which would mislabel them
+			h.desc = s.opts.Naming.describe(name, labels, UnitNone)
+			h.desc.scale = 1e-6
+		}
+	}
+	return h
+}
+
+func (s *statsdMetricsProvider) resetsInstrument() IncrementInstrument {
+	return s.counterResets
+}
+
+// send queues a single metric line, sending the queued lines first if the
+// line doesn't fit in the current packet
+func (s *statsdMetricsProvider) send(desc *metricDesc, value string, metricType string, labels map[string]string) {
+	line := s.format(desc.name, value, metricType, desc.withConstLabels(labels))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > s.opts.MaxPacketSize {
+		if err := s.write(); err != nil {
+			s.logger.Errorf("could not send statsd metrics: %v", err)
+		}
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+func (s *statsdMetricsProvider) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write()
+}
+
+// write must be called with s.mu held
+func (s *statsdMetricsProvider) write() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
+
+func (s *statsdMetricsProvider) format(name string, value string, metricType string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(s.opts.Prefix)
+	b.WriteString(sanitizeStatsd(name))
+	if !s.opts.DogStatsD {
+		for _, k := range keys {
+			b.WriteString(".")
+			b.WriteString(sanitizeStatsd(k))
+			b.WriteString("_")
+			b.WriteString(sanitizeStatsd(labels[k]))
+		}
+	}
+	b.WriteString(":")
+	b.WriteString(value)
+	b.WriteString("|")
+	b.WriteString(metricType)
+	if s.opts.DogStatsD && len(keys) > 0 {
+		b.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(sanitizeStatsdTag(k))
+			b.WriteString(":")
+			b.WriteString(sanitizeStatsdTag(labels[k]))
+		}
+	}
+	return b.String()
+}
+
+var (
+	// Dots separate the segments of a metric name, so they are replaced as well
+	statsdNameReplacer = strings.NewReplacer(
+		":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_", " ", "_", ".", "_",
+	)
+	statsdTagReplacer = strings.NewReplacer(
+		"|", "_", "@", "_", ",", "_", "#", "_", "\n", "_",
+	)
+)
+
+// sanitizeStatsd replaces the characters which are part of the statsd line format
+func sanitizeStatsd(s string) string {
+	return statsdNameReplacer.Replace(s)
+}
+
+func sanitizeStatsdTag(s string) string {
+	return statsdTagReplacer.Replace(s)
+}
+
+type statsdSetCounter struct {
+	provider *statsdMetricsProvider
+	// name of the map, for counting resets
+	name string
+	desc metricDesc
+
+	mu         sync.Mutex
+	counterMap map[uint64]int64
+	resets     IncrementInstrument
+	tracker    *seriesTracker
+}
+
+func (c *statsdSetCounter) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	keyHash, err := hashstructure.Hash(decodedKey, hashstructure.FormatV2, nil)
+	if err != nil {
+		log.Fatal("This should never happen")
+	}
+
+	c.tracker.touchHash(keyHash, decodedKey)
+	c.mu.Lock()
+	oldVal := c.counterMap[keyHash]
+	c.counterMap[keyHash] = intVal
+	c.mu.Unlock()
+
+	if oldVal == intVal {
+		return
+	}
+	diff, reset := counterDelta(oldVal, intVal)
+	if reset {
+		c.resets.Increment(ctx, map[string]string{"map": c.name})
+	}
+	value := strconv.FormatUint(diff, 10)
+	if c.desc.scale != 1 {
+		value = strconv.FormatFloat(c.desc.value(float64(diff)), 'f', -1, 64)
+	}
+	c.provider.send(&c.desc, value, "c", decodedKey)
+}
+
+func (c *statsdSetCounter) expire(before time.Time) {
+	stale := c.tracker.expire(before)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, series := range stale {
+		delete(c.counterMap, series.hash)
+	}
+}
+
+type statsdIncrementCounter struct {
+	provider *statsdMetricsProvider
+	desc     metricDesc
+}
+
+func (i *statsdIncrementCounter) Increment(
+	ctx context.Context,
+	decodedKey map[string]string,
+) {
+	i.provider.send(&i.desc, "1", "c", decodedKey)
+}
+
+func (i *statsdIncrementCounter) Add(
+	ctx context.Context,
+	val int64,
+	decodedKey map[string]string,
+) {
+	i.provider.send(&i.desc, statsdValue(&i.desc, val), "c", decodedKey)
+}
+
+type statsdGauge struct {
+	provider *statsdMetricsProvider
+	desc     metricDesc
+}
+
+func (g *statsdGauge) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	// A signed gauge value adjusts the current value rather than setting it,
+	// so negative values are set by resetting to 0 first
+	if intVal < 0 {
+		g.provider.send(&g.desc, "0", "g", decodedKey)
+	}
+	g.provider.send(&g.desc, statsdValue(&g.desc, intVal), "g", decodedKey)
+}
+
+type statsdHistogram struct {
+	provider   *statsdMetricsProvider
+	desc       metricDesc
+	metricType string
+}
+
+func (h *statsdHistogram) Set(
+	ctx context.Context,
+	intVal int64,
+	decodedKey map[string]string,
+) {
+	h.provider.send(&h.desc, statsdValue(&h.desc, intVal), h.metricType, decodedKey)
+}
+
+// statsdValue formats a raw value in the unit it is exported in, values
+// which aren't converted stay exact integers
+func statsdValue(desc *metricDesc, raw int64) string {
+	if desc.scale == 1 {
+		return strconv.FormatInt(raw, 10)
+	}
+	return strconv.FormatFloat(desc.value(float64(raw)), 'f', -1, 64)
+}
@@ -0,0 +1,87 @@
+package stats
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdMetricsProvider(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	provider, err := NewStatsdMetricsProvider(ctx, &StatsdOpts{
+		Address:       agent.LocalAddr().String(),
+		DogStatsD:     true,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := provider.NewSetCounter("bytes", []string{"daddr"}, UnitNone)
+	counter.Set(ctx, 10, map[string]string{"daddr": "1.1.1.1"})
+	counter.Set(ctx, 25, map[string]string{"daddr": "1.1.1.1"})
+	// the map entry was reset
+	counter.Set(ctx, 5, map[string]string{"daddr": "1.1.1.1"})
+	provider.NewGauge("queue", []string{}, UnitNone).Set(ctx, -3, map[string]string{})
+
+	// metrics are flushed once more on shutdown, which waits for the flush
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := provider.(Shutdowner).Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := agent.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+
+	expected := []string{
+		"ebpf_solo_io.bytes:10|c|#daddr:1.1.1.1",
+		"ebpf_solo_io.bytes:15|c|#daddr:1.1.1.1",
+		"ebpf_solo_io.bee_counter_resets:1|c|#map:bytes",
+		"ebpf_solo_io.bytes:5|c|#daddr:1.1.1.1",
+		"ebpf_solo_io.queue:0|g",
+		"ebpf_solo_io.queue:-3|g",
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected lines\n%s\nfound\n%s", strings.Join(expected, "\n"), string(buf[:n]))
+	}
+}
+
+func TestStatsdFormatPlain(t *testing.T) {
+	s := &statsdMetricsProvider{opts: StatsdOpts{Prefix: "bee."}}
+	line := s.format("open events", "1", "c", map[string]string{"comm": "curl", "daddr": "10.0.0.1"})
+	if line != "bee.open_events.comm_curl.daddr_10_0_0_1:1|c" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestStatsdDurations(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		dogStatsD bool
+		expected  string
+	}{
+		// StatsD timers are in milliseconds, so they aren't suffixed with seconds
+		{dogStatsD: false, expected: "bee.latency:1.5|ms"},
+		{dogStatsD: true, expected: "bee.latency_seconds:0.0015|h"},
+	} {
+		s := &statsdMetricsProvider{opts: StatsdOpts{Prefix: "bee.", DogStatsD: tc.dogStatsD, MaxPacketSize: 1432}}
+		s.NewHistogram("latency", []string{}, nil, UnitNanoseconds).Set(ctx, 1500000, map[string]string{})
+		if line := s.buf.String(); line != tc.expected {
+			t.Errorf("expected %q with DogStatsD %t, found %q", tc.expected, tc.dogStatsD, line)
+		}
+	}
+}